@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	codeUnauthorized = "unauthorized"
+	codeForbidden    = "forbidden"
+)
+
+// permissions are key prefixes a token may read and write. Empty prefix
+// matches every key.
+type permissions struct {
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+}
+
+// authConfig is the auth config file, e.g.
+//
+//	{"tokens": {"secret": {"read": [""], "write": ["users/"]}}}
+type authConfig struct {
+	Tokens map[string]permissions `json:"tokens"`
+}
+
+func loadAuthConfig(path string) (*authConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var conf authConfig
+	if err := json.NewDecoder(f).Decode(&conf); err != nil {
+		return nil, fmt.Errorf("invalid auth config %s: %w", path, err)
+	}
+	if len(conf.Tokens) == 0 {
+		return nil, fmt.Errorf("auth config %s has no tokens", path)
+	}
+	return &conf, nil
+}
+
+// authHandler checks bearer tokens of requests before passing them to the
+// next handler. Requests without a known token get 401, requests for keys
+// outside of the token prefixes get 403.
+type authHandler struct {
+	conf *authConfig
+	next http.Handler
+}
+
+func (a *authHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	perms, ok := a.authenticate(r)
+	if !ok {
+		rw.Header().Set("www-authenticate", `Bearer realm="db"`)
+		writeError(rw, http.StatusUnauthorized, codeUnauthorized, "missing or unknown bearer token")
+		return
+	}
+
+	keys, write, err := access(rw, r)
+	if err == errBodyTooLarge {
+		writeError(rw, http.StatusRequestEntityTooLarge, codeTooLarge, err.Error())
+		return
+	} else if err != nil {
+		// Invalid requests are rejected by the next handler.
+		a.next.ServeHTTP(rw, r)
+		return
+	}
+
+	prefixes := perms.Read
+	if write {
+		prefixes = perms.Write
+	}
+	for _, k := range keys {
+		if !hasPrefix(prefixes, k) {
+			log.Printf("Access to %q is denied", k)
+			writeError(rw, http.StatusForbidden, codeForbidden, fmt.Sprintf("access to %q is denied", k))
+			return
+		}
+	}
+	a.next.ServeHTTP(rw, r)
+}
+
+func (a *authHandler) authenticate(r *http.Request) (permissions, bool) {
+	header := r.Header.Get("authorization")
+	const scheme = "bearer "
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return permissions{}, false
+	}
+	token := []byte(strings.TrimSpace(header[len(scheme):]))
+
+	// Every token is compared so that timing does not reveal which one matched.
+	var (
+		perms permissions
+		found bool
+	)
+	for t, p := range a.conf.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), token) == 1 {
+			perms, found = p, true
+		}
+	}
+	return perms, found
+}
+
+// access returns keys the request reads or writes. Watch needs access to
+// the watched prefix, admin and replication endpoints need access to all keys.
+func access(rw http.ResponseWriter, r *http.Request) (keys []string, write bool, err error) {
+	switch r.URL.Path {
+	case keyPrefix + "watch":
+		return []string{r.URL.Query().Get("prefix")}, false, nil
+	case keyPrefix + "_mget":
+		body, err := readBody(rw, r, maxGetManyBody)
+		if err != nil {
+			return nil, false, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var req getManyRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, false, err
+		}
+		return req.Keys, false, nil
+	case "/admin/export", replicationPath:
+		return []string{""}, false, nil
+	case "/admin/import":
+		return []string{""}, true, nil
+	}
+
+	if !strings.HasPrefix(r.URL.Path, keyPrefix) {
+		return nil, false, nil
+	}
+	k, err := key(r)
+	if err != nil {
+		return nil, false, err
+	}
+	write = r.Method != http.MethodGet && r.Method != http.MethodHead
+	return []string{k}, write, nil
+}
+
+func hasPrefix(prefixes []string, key string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
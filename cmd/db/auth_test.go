@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthHandler(t *testing.T) {
+	db, dir := openTestDb(t)
+	defer os.RemoveAll(dir)
+	defer db.Close()
+
+	confPath := filepath.Join(dir, "auth.json")
+	conf := `{"tokens": {
+		"admin": {"read": [""], "write": [""]},
+		"users": {"read": ["users/", "public/"], "write": ["users/"]}
+	}}`
+	if err := ioutil.WriteFile(confPath, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authConf, err := loadAuthConfig(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &authHandler{conf: authConf, next: newHandler(db, false)}
+	for _, c := range []handlerTestCase{
+		{
+			Name:     "no token",
+			Method:   http.MethodGet,
+			Path:     "/db/users/1",
+			Status:   http.StatusUnauthorized,
+			Response: `{"code":"unauthorized","message":"missing or unknown bearer token"}`,
+		},
+		{
+			Name:   "unknown token",
+			Method: http.MethodGet,
+			Path:   "/db/users/1",
+			Token:  "guess",
+			Status: http.StatusUnauthorized,
+		},
+		{
+			Name:   "write own prefix",
+			Method: http.MethodPut,
+			Path:   "/db/users/1",
+			Token:  "users",
+			Body:   `{"value":"alice"}`,
+			Status: http.StatusOK,
+		},
+		{
+			Name:     "read own prefix",
+			Method:   http.MethodGet,
+			Path:     "/db/users/1",
+			Token:    "users",
+			Status:   http.StatusOK,
+			Response: `{"key":"users/1","type":"string","value":"alice"}`,
+		},
+		{
+			Name:     "write read-only prefix",
+			Method:   http.MethodPut,
+			Path:     "/db/public/motd",
+			Token:    "users",
+			Body:     `{"value":"hi"}`,
+			Status:   http.StatusForbidden,
+			Response: `{"code":"forbidden","message":"access to \"public/motd\" is denied"}`,
+		},
+		{
+			Name:   "admin write",
+			Method: http.MethodPut,
+			Path:   "/db/public/motd",
+			Token:  "admin",
+			Body:   `{"value":"hi"}`,
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "read other prefix",
+			Method: http.MethodGet,
+			Path:   "/db/secret",
+			Token:  "users",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "delete encoded key",
+			Method: http.MethodDelete,
+			Path:   "/db/users%2F2",
+			Token:  "users",
+			Status: http.StatusNotFound,
+		},
+		{
+			Name:   "get many",
+			Method: http.MethodPost,
+			Path:   "/db/_mget",
+			Token:  "users",
+			Body:   `{"keys":["users/1","public/motd"]}`,
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "get many other prefix",
+			Method: http.MethodPost,
+			Path:   "/db/_mget",
+			Token:  "users",
+			Body:   `{"keys":["users/1","secret"]}`,
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "export",
+			Method: http.MethodGet,
+			Path:   "/admin/export",
+			Token:  "users",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "replication",
+			Method: http.MethodGet,
+			Path:   replicationPath,
+			Token:  "users",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "watch other prefix",
+			Method: http.MethodGet,
+			Path:   "/db/watch?prefix=use",
+			Token:  "users",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "invalid body",
+			Method: http.MethodPost,
+			Path:   "/db/_mget",
+			Token:  "users",
+			Body:   `{"keys":`,
+			Status: http.StatusBadRequest,
+		},
+		{
+			Name:   "get many too large",
+			Method: http.MethodPost,
+			Path:   "/db/_mget",
+			Token:  "users",
+			Body:   `{"keys":["users/` + strings.Repeat("1", maxGetManyBody) + `"]}`,
+			Status: http.StatusRequestEntityTooLarge,
+		},
+	} {
+		c.test(t, h)
+	}
+
+	t.Run("invalid config", func(t *testing.T) {
+		if err := ioutil.WriteFile(confPath, []byte(`{"tokens": {}}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadAuthConfig(confPath); err == nil {
+			t.Error("Config without tokens must be rejected")
+		}
+	})
+}
@@ -1,132 +1,89 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"github.com/OlegVanyaGreatBand/kpi-lab-2/cmd/db/datastore"
 	"github.com/OlegVanyaGreatBand/kpi-lab-2/httptools"
 	"github.com/OlegVanyaGreatBand/kpi-lab-2/signal"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"strings"
+	"time"
 )
 
 var dbDir = flag.String("dir", ".", "database directory")
 var port = flag.Int("port", 8070, "database server port")
+var compressThreshold = flag.Int("compress-threshold", 0, "compress values of at least this many bytes (0 disables compression)")
+var indexMemory = flag.Int64("index-memory", 0, "memory budget in bytes for indexes of sealed segments (0 keeps all indexes in memory)")
+var primary = flag.String("primary", "", "primary database url, e.g. http://database:8070; if set, the server runs as a read-only replica")
+var primaryToken = flag.String("primary-token", "", "bearer token used to replicate from the primary")
+var authConfigPath = flag.String("auth-config", "", "auth config file with bearer tokens and their key prefixes (empty disables auth)")
+var tlsCert = flag.String("tls-cert", "", "certificate file to serve HTTPS with")
+var tlsKey = flag.String("tls-key", "", "private key file of the HTTPS certificate")
+var tlsClientCA = flag.String("tls-client-ca", "", "CA file to verify client certificates with (mutual TLS)")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "time to wait for in-flight requests on shutdown")
 
 func main() {
 	flag.Parse()
-	db, err := datastore.NewDb(*dbDir)
+	ctx := signal.TerminationContext()
+	db, err := datastore.NewDb(*dbDir,
+		datastore.WithCompression(*compressThreshold),
+		datastore.WithMemoryBudget(*indexMemory))
 	if err != nil {
 		log.Fatalf("Failed to start database: %s", err)
 	}
-	db.Put("test", "gav")
+	// Replicas get all their data from the primary.
+	if *primary == "" {
+		db.Put("test", "gav")
+	}
 	log.Printf("Database started at directory: %s", *dbDir)
 
-	h := new(http.ServeMux)
-	h.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
-		rw.Header().Set("content-type", "application/json")
-		k := strings.Split(r.URL.Path, "/")[2]
-		encoder := json.NewEncoder(rw)
-
-		if r.Method == http.MethodGet {
-			log.Printf("GET request for %s", k)
-			v, err := db.Get(k)
-			if err != nil {
-				log.Printf("Failed to get %s: %s", k, err)
-				if err == datastore.ErrNotFound {
-					rw.WriteHeader(http.StatusNotFound)
-				} else if err == datastore.ErrWrongType {
-					v, err := db.GetInt64(k)
-					if err != nil {
-						log.Printf("Failed to load %s: %s", k, err)
-						rw.WriteHeader(http.StatusInternalServerError)
-						return
-					}
-
-					log.Printf("Got %s as int64", k)
-					res := struct {
-						Key string `json:"key"`
-						Value int64 `json:"value"`
-					}{
-						Key: k,
-						Value: v,
-					}
-					rw.WriteHeader(http.StatusOK)
-					if err := encoder.Encode(res); err != nil {
-						log.Printf("Failed to write response %d: %s", v, err)
-					}
-					return
-				} else {
-					rw.WriteHeader(http.StatusInternalServerError)
-				}
-				return
-			}
-
-			log.Printf("Got %s as string", k)
-			res := struct {
-				Key string `json:"key"`
-				Value string `json:"value"`
-			}{
-				Key: k,
-				Value: v,
-			}
-			rw.WriteHeader(http.StatusOK)
-			if err := encoder.Encode(res); err != nil {
-				log.Printf("Failed to write response %s: %s", v, err)
-			}
-		} else if r.Method == http.MethodPost {
-			log.Printf("POST request for %s", k)
-
-			bytes, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				log.Printf("Error decoding input: %s", err)
-				rw.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			var jsonFields map[string]*json.RawMessage
-			err = json.Unmarshal(bytes, &jsonFields)
-			if err != nil {
-				log.Printf("Error decoding input: %s", err)
-				rw.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			var int64Value int64
-			err = json.Unmarshal(*jsonFields["value"], &int64Value)
-			if err != nil {
-				var stringValue string
-				err = json.Unmarshal(*jsonFields["value"], &stringValue)
-				if err != nil {
-					log.Printf("Error decoding input: %s", err)
-					rw.WriteHeader(http.StatusBadRequest)
-					return
-				}
-
-				log.Printf("Decoded string: %s", stringValue)
-				if err := db.Put(k, stringValue); err != nil {
-					rw.WriteHeader(http.StatusInternalServerError)
-					log.Printf("Failed to set %s -> \"%s\": %s", k, stringValue, err)
-					return
-				}
-				rw.WriteHeader(http.StatusOK)
-				return
-			}
-
-			log.Printf("Decoded int64: %d", int64Value)
-			if err := db.PutInt64(k, int64Value); err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				log.Printf("Failed to set %s -> %d: %s", k, int64Value, err)
-				return
-			}
-
-			rw.WriteHeader(http.StatusOK)
+	replicaDone := make(chan struct{})
+	if *primary != "" {
+		rp := &replica{
+			db:      db,
+			primary: *primary,
+			token:   *primaryToken,
+			client:  new(http.Client),
+			retry:   time.Second,
 		}
-	})
+		go func() {
+			rp.run(ctx)
+			close(replicaDone)
+		}()
+	} else {
+		close(replicaDone)
+	}
 
-	server := httptools.CreateServer(*port, h)
+	dbHandler := newHandler(db, *primary != "")
+	var h http.Handler = dbHandler
+	if *authConfigPath != "" {
+		conf, err := loadAuthConfig(*authConfigPath)
+		if err != nil {
+			log.Fatalf("Failed to load auth config: %s", err)
+		}
+		h = &authHandler{conf: conf, next: h}
+		log.Printf("Authentication enabled for %d tokens", len(conf.Tokens))
+	}
+	// Export, watch and replication responses are long-lived streams.
+	server := httptools.CreateServer(*port, h,
+		httptools.WithWriteTimeout(0),
+		httptools.WithTLS(*tlsCert, *tlsKey),
+		httptools.WithClientCA(*tlsClientCA))
 	server.Start()
-	signal.WaitForTerminationSignal()
+	<-ctx.Done()
+
+	// Streams never become idle, so they are finished before draining requests.
+	dbHandler.stopStreams()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down the server: %s", err)
+	}
+
+	<-replicaDone
+	if err := db.Close(); err != nil {
+		log.Printf("Failed to close database: %s", err)
+	}
+	log.Println("Database is closed")
 }
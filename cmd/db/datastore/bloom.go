@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+var ErrBadBloomFilter = fmt.Errorf("bad bloom filter")
+
+// bloomFilter answers whether a key may be present in a sealed segment.
+// False positives are possible, false negatives are not.
+type bloomFilter struct {
+	bits []uint64
+	k    uint32
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	words := (keys*bloomBitsPerKey + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &bloomFilter{
+		bits: make([]uint64, words),
+		k:    bloomHashes,
+	}
+}
+
+// bloomHash returns two hashes of the key that are combined to get k bit
+// positions (Kirsch-Mitzenmacher double hashing over FNV-1a). It is computed
+// once per lookup and reused for the filters of all segments.
+func bloomHash(key string) bloomKey {
+	sum := uint64(fnvOffset64)
+	for i := 0; i < len(key); i++ {
+		sum ^= uint64(key[i])
+		sum *= fnvPrime64
+	}
+	return bloomKey{uint32(sum), uint32(sum>>32) | 1}
+}
+
+type bloomKey struct {
+	h1, h2 uint32
+}
+
+func (f *bloomFilter) add(key string) {
+	h := bloomHash(key)
+	m := uint32(len(f.bits) * 64)
+	for i := uint32(0); i < f.k; i++ {
+		bit := (h.h1 + i*h.h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) mayContain(h bloomKey) bool {
+	m := uint32(len(f.bits) * 64)
+	for i := uint32(0); i < f.k; i++ {
+		bit := (h.h1 + i*h.h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) Encode() []byte {
+	res := make([]byte, 8+len(f.bits)*8)
+	binary.LittleEndian.PutUint32(res, f.k)
+	binary.LittleEndian.PutUint32(res[4:], uint32(len(f.bits)))
+	for i, w := range f.bits {
+		binary.LittleEndian.PutUint64(res[8+i*8:], w)
+	}
+	return res
+}
+
+// Decode reads the filter from input and returns the number of bytes consumed.
+func (f *bloomFilter) Decode(input []byte) (int, error) {
+	if len(input) < 8 {
+		return 0, ErrBadBloomFilter
+	}
+	f.k = binary.LittleEndian.Uint32(input)
+	words := int(binary.LittleEndian.Uint32(input[4:]))
+	if words == 0 || len(input) < 8+words*8 {
+		return 0, ErrBadBloomFilter
+	}
+
+	f.bits = make([]uint64, words)
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(input[8+i*8:])
+	}
+	return 8 + words*8, nil
+}
@@ -0,0 +1,165 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 1000
+	f := newBloomFilter(n)
+	for i := 0; i < n; i++ {
+		f.add("key" + strconv.Itoa(i))
+	}
+
+	var decoded bloomFilter
+	if _, err := decoded.Decode(f.Encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		if !decoded.mayContain(bloomHash("key" + strconv.Itoa(i))) {
+			t.Fatalf("False negative for key%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if decoded.mayContain(bloomHash("missing" + strconv.Itoa(i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > n/20 {
+		t.Errorf("Too many false positives: %d of %d", falsePositives, n)
+	}
+
+	if _, err := decoded.Decode([]byte{1, 2, 3}); err != ErrBadBloomFilter {
+		t.Errorf("Expected ErrBadBloomFilter, got %v", err)
+	}
+}
+
+func TestDb_Hint(t *testing.T) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSized(dir, testSegSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.segments) < 3 {
+		t.Fatalf("Expected several segments, got %d", len(db.segments))
+	}
+	for _, s := range db.segments[:len(db.segments)-1] {
+		if s.filter == nil {
+			t.Errorf("Sealed segment %s has no bloom filter", s.path)
+		}
+		if _, err := os.Stat(s.hintPath()); err != nil {
+			t.Errorf("Cannot read hint file: %s", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing hint file must be rebuilt from the segment.
+	if err := os.Remove(filepath.Join(dir, segFileName+"1"+hintSuffix)); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDbSized(dir, testSegSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, segFileName+"1"+hintSuffix)); err != nil {
+		t.Errorf("Hint file was not rebuilt: %s", err)
+	}
+	for i := 0; i < 30; i++ {
+		value, err := db.Get("key" + strconv.Itoa(i))
+		if err != nil {
+			t.Errorf("Cannot get key%d: %s", i, err)
+		}
+		if value != "value"+strconv.Itoa(i) {
+			t.Errorf("Bad value returned expected value%d, got %s", i, value)
+		}
+	}
+	if _, err := db.Get("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func BenchmarkDb_GetMissing(b *testing.B) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "bench-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSized(dir, 1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10000; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Logf("%d segments", len(db.segments))
+
+	getMissing := func(b *testing.B, bloom bool) {
+		filters := make([]*bloomFilter, len(db.segments))
+		for i, s := range db.segments {
+			filters[i] = s.filter
+			if !bloom {
+				s.filter = nil
+			}
+		}
+		defer func() {
+			for i, s := range db.segments {
+				s.filter = filters[i]
+			}
+		}()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get("missing" + strconv.Itoa(i)); err != ErrNotFound {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("bloom", func(b *testing.B) {
+		getMissing(b, true)
+	})
+	b.Run("no bloom", func(b *testing.B) {
+		getMissing(b, false)
+	})
+
+	for _, s := range db.segments[:len(db.segments)-1] {
+		if err := s.spill(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Run("on-disk index bloom", func(b *testing.B) {
+		getMissing(b, true)
+	})
+	b.Run("on-disk index no bloom", func(b *testing.B) {
+		getMissing(b, false)
+	})
+}
@@ -1,12 +1,16 @@
 package datastore
 
 import (
+	"bufio"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -19,6 +23,8 @@ const (
 	typeString = iota
 	typeInt64 = iota
 	typeClose = iota
+	typeDelete = iota
+	typeBytes = iota
 )
 
 type Db struct {
@@ -29,30 +35,67 @@ type Db struct {
 	writeQueue chan writeRequest
 	mergeQueue chan interface{}
 	closed bool
+	compressThreshold int
+	memoryBudget int64
+	// seq is the sequence number of the last write. It is changed by loop
+	// with the write lock held.
+	seq uint64
+	watchMu sync.Mutex
+	watchers map[*Watcher]struct{}
+}
+
+// Option configures optional database behaviour.
+type Option func(db *Db)
+
+// WithCompression enables deflate compression of values that are at least
+// threshold bytes long. Reads decompress such values transparently.
+func WithCompression(threshold int) Option {
+	return func(db *Db) {
+		db.compressThreshold = threshold
+	}
+}
+
+// WithMemoryBudget limits the memory used by indexes of sealed segments to
+// approximately budget bytes. Indexes that do not fit are kept on disk in
+// hint files with only a sparse index in memory. Non-positive budget means
+// that all indexes are kept in memory.
+func WithMemoryBudget(budget int64) Option {
+	return func(db *Db) {
+		db.memoryBudget = budget
+	}
 }
 
 type writeRequest struct {
 	key string
 	value interface{}
 	valueType int
+	// seq is set for writes replicated from another database.
+	seq uint64
+	// ifVersion is set for conditional writes.
+	ifVersion *uint64
 	result chan error
 }
 
 // NewDb Create new database with default segment size
 // Note that creating two dbs in the same directory may lead to data races and data corruption
-func NewDb(dir string) (*Db, error) {
-	return NewDbSized(dir, defSegSize)
+func NewDb(dir string, opts ...Option) (*Db, error) {
+	return NewDbSized(dir, defSegSize, opts...)
 }
 
 // NewDbSized Create new database with provided segment size.
+// Options such as WithMemoryBudget and WithCompression may be provided.
 // Note that creating two dbs in the same directory may lead to data races and data corruption
-func NewDbSized(dir string, segSize int64) (*Db, error) {
+func NewDbSized(dir string, segSize int64, opts ...Option) (*Db, error) {
 	db := &Db{
 		outPath: dir,
 		segments: nil,
 		maxSegSize: segSize,
 		writeQueue: make(chan writeRequest),
 		mergeQueue: make(chan interface{}),
+		watchers: make(map[*Watcher]struct{}),
+	}
+	for _, opt := range opts {
+		opt(db)
 	}
 
 	err := db.recover()
@@ -65,31 +108,92 @@ func NewDbSized(dir string, segSize int64) (*Db, error) {
 	}
 	go db.loop()
 
+	if err := db.sequenceLegacy(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
 
 func (db *Db) loop() {
 	for e := range db.writeQueue {
-		var err error
+		var rec entry
 		switch e.valueType {
 		case typeString:
-			db.Lock()
-			err = db.lastSegment().put(e.key, e.value.(string))
-			db.Unlock()
+			rec = entry{
+				key:       e.key,
+				value:     []byte(e.value.(string)),
+				valueType: typeString,
+			}
 		case typeInt64:
-			db.Lock()
-			err = db.lastSegment().putInt64(e.key, e.value.(int64))
-			db.Unlock()
+			b := make([]byte, 8)
+			binary.LittleEndian.PutUint64(b, uint64(e.value.(int64)))
+			rec = entry{
+				key:       e.key,
+				value:     b,
+				valueType: typeInt64,
+			}
+		case typeBytes:
+			rec = entry{
+				key:       e.key,
+				value:     e.value.([]byte),
+				valueType: typeBytes,
+			}
+		case typeDelete:
+			rec = entry{
+				key:       e.key,
+				valueType: typeDelete,
+			}
 		case typeClose:
 			return
 		}
 
+		// Replicated writes keep their sequence number and are applied only once.
+		if e.seq != 0 && e.seq <= db.seq {
+			e.result <- nil
+			continue
+		}
+
+		err := rec.compress(db.compressThreshold)
+		if err == nil && e.ifVersion != nil {
+			err = db.checkVersion(e.key, *e.ifVersion)
+		}
+		if err == nil && e.valueType == typeDelete && e.seq == 0 {
+			db.RLock()
+			_, err = db.find(e.key)
+			db.RUnlock()
+		}
+		if err == nil {
+			rec.seq = e.seq
+			if rec.seq == 0 {
+				rec.seq = db.seq + 1
+			}
+			db.Lock()
+			err = db.lastSegment().write(rec)
+			if err == nil {
+				db.seq = rec.seq
+			}
+			db.Unlock()
+		}
+
 		if err != nil {
 			e.result <- err
 			continue
 		}
 
-		if db.lastSegment().offset >= db.maxSegSize {
+		db.publish(Event{
+			Type:  eventType(e.valueType),
+			Key:   e.key,
+			Value: e.value,
+			Seq:   rec.seq,
+		})
+
+		// Segments are replaced by merge under the lock.
+		db.RLock()
+		full := db.lastSegment().offset >= db.maxSegSize
+		db.RUnlock()
+		if full {
 			err := db.newSegment()
 			e.result <- err
 			continue
@@ -104,7 +208,10 @@ func (db *Db) mergeLoop() {
 		if v == typeClose {
 			return
 		}
-		if len(db.segments) > 2 {
+		db.RLock()
+		n := len(db.segments)
+		db.RUnlock()
+		if n > 2 {
 			err := db.merge()
 			if err != nil {
 				log.Printf("Cannot merge: %s", err)
@@ -119,21 +226,51 @@ func (db *Db) recover() error {
 		return err
 	}
 
-	var segments []*segment
+	// Segment files are ordered by their number, hint and merge files are skipped.
+	var numbers []int
 	for _, file := range files {
 		if !file.IsDir() && strings.HasPrefix(file.Name(), segFileName) {
-			if file.Name() == segFileName + "merged" {
+			n, err := strconv.Atoi(file.Name()[len(segFileName):])
+			if err != nil {
 				continue
 			}
-			path := filepath.Join(db.outPath, file.Name())
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+
+	// Segments are opened from the newest one, indexes of older segments are
+	// loaded to disk once the memory budget is used up.
+	segments := make([]*segment, len(numbers))
+	var used int64
+	for i := len(numbers) - 1; i >= 0; i-- {
+		path := filepath.Join(db.outPath, fmt.Sprintf("%s%d", segFileName, numbers[i]))
+
+		var (
+			seg *segment
+			err error
+		)
+		if i == len(numbers) - 1 {
+			seg, err = createSegment(path)
+		} else {
+			seg, err = openSealedSegment(path, db.memoryBudget > 0 && used >= db.memoryBudget)
+		}
+		if err != nil {
+			return err
+		}
 
-			seg, err := createSegment(path)
-			if err != nil {
-				return err
+		if i < len(numbers) - 1 && seg.index != nil && db.memoryBudget > 0 {
+			used += seg.memSize()
+			if used > db.memoryBudget {
+				before := seg.memSize()
+				if err := seg.spill(); err != nil {
+					log.Printf("Cannot move index of %s to disk: %s", seg.path, err)
+				} else {
+					used -= before - seg.memSize()
+				}
 			}
-
-			segments = append(segments, seg)
 		}
+		segments[i] = seg
 	}
 
 	if len(segments) == 0 {
@@ -153,10 +290,48 @@ func (db *Db) recover() error {
 	}
 
 	db.segments = segments
+	for _, seg := range segments {
+		if seg.maxSeq > db.seq {
+			db.seq = seg.maxSeq
+		}
+	}
+	db.enforceMemoryBudget()
 
 	return nil
 }
 
+// enforceMemoryBudget moves indexes of sealed segments to disk, starting from
+// the oldest ones, until the in-memory indexes fit into the memory budget.
+// The active segment and segments being merged keep their indexes in memory.
+// Must be called with the write lock held.
+func (db *Db) enforceMemoryBudget() {
+	if db.memoryBudget <= 0 {
+		return
+	}
+
+	sealed := db.segments[:len(db.segments) - 1]
+	var used int64
+	for _, s := range sealed {
+		used += s.memSize()
+	}
+
+	for _, s := range sealed {
+		if used <= db.memoryBudget {
+			return
+		}
+		if s.index == nil || s.merging {
+			continue
+		}
+
+		before := s.memSize()
+		if err := s.spill(); err != nil {
+			log.Printf("Cannot move index of %s to disk: %s", s.path, err)
+			continue
+		}
+		used -= before - s.memSize()
+	}
+}
+
 func createSegment(path string) (*segment, error) {
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
@@ -178,6 +353,44 @@ func createSegment(path string) (*segment, error) {
 	return seg, nil
 }
 
+// openSealedSegment opens a segment that is not written anymore. Its index and
+// bloom filter are loaded from the hint file, which is rebuilt if missing or stale.
+// If spilled is set, the index is left on disk.
+func openSealedSegment(path string, spilled bool) (*segment, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &segment{
+		offset: 0,
+		path:  path,
+		file:  f,
+		index: make(hashIndex),
+	}
+
+	if err := seg.loadHint(spilled); err == nil {
+		return seg, nil
+	}
+
+	err = seg.recover()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	seg.filter, err = seg.seal()
+	if err != nil {
+		return nil, err
+	}
+
+	if spilled {
+		if err := seg.spill(); err != nil {
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
 // Close current database.
 func (db *Db) Close() error {
 	db.writeQueue <- writeRequest{valueType: typeClose}
@@ -185,7 +398,7 @@ func (db *Db) Close() error {
 		db.mergeQueue <- typeClose
 	}
 
-	db.closed = true
+	db.closeWatchers()
 
 	for _, s := range db.segments {
 		if err := s.close(); err != nil {
@@ -195,36 +408,106 @@ func (db *Db) Close() error {
 	return nil
 }
 
+// find returns the latest record of the key. Deleted keys are reported as ErrNotFound.
+// Must be called with the read lock held.
+func (db *Db) find(key string) (entry, error) {
+	h := bloomHash(key)
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		if !db.segments[i].mayContain(h) {
+			continue
+		}
+		e, err := db.segments[i].getEntry(key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return entry{}, err
+		}
+
+		if e.kind() == typeDelete {
+			return entry{}, ErrNotFound
+		}
+		return e, nil
+	}
+
+	return entry{}, ErrNotFound
+}
+
 // Get the value from database.
 // This operation may block thread if there is ongoing write operations.
 func (db *Db) Get(key string) (string, error) {
 	db.RLock()
 	defer db.RUnlock()
-	for i := len(db.segments) - 1; i >= 0; i-- {
-		v, err := db.segments[i].get(key)
-		if err == nil {
-			return v, nil
-		} else if err == ErrWrongType {
-			return "", err
-		}
+	e, err := db.find(key)
+	if err != nil {
+		return "", err
+	}
+	if e.kind() != typeString {
+		return "", ErrWrongType
 	}
 
-	return "", ErrNotFound
+	value, err := e.plainValue()
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
 }
 
 func (db *Db) GetInt64(key string) (int64, error) {
 	db.RLock()
 	defer db.RUnlock()
-	for i := len(db.segments) - 1; i >= 0; i-- {
-		v, err := db.segments[i].getInt64(key)
-		if err == nil {
-			return v, nil
-		} else if err == ErrWrongType {
-			return 0, err
-		}
+	e, err := db.find(key)
+	if err != nil {
+		return 0, err
+	}
+	if e.kind() != typeInt64 {
+		return 0, ErrWrongType
 	}
 
-	return 0, ErrNotFound
+	value, err := e.plainValue()
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(value)), nil
+}
+
+// GetBytes returns the value stored with PutBytes.
+func (db *Db) GetBytes(key string) ([]byte, error) {
+	db.RLock()
+	defer db.RUnlock()
+	e, err := db.find(key)
+	if err != nil {
+		return nil, err
+	}
+	if e.kind() != typeBytes {
+		return nil, ErrWrongType
+	}
+
+	return e.plainValue()
+}
+
+// GetMany returns values of the keys, which are string, int64 or []byte.
+// Missing keys are not included in the result. All keys are looked up under
+// a single read lock, so no write happens in between.
+func (db *Db) GetMany(keys []string) (map[string]interface{}, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	values := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		e, err := db.find(key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		event, err := e.event()
+		if err != nil {
+			return nil, err
+		}
+		values[key] = event.Value
+	}
+	return values, nil
 }
 
 func (db *Db) lastSegment() *segment {
@@ -258,8 +541,41 @@ func (db *Db) PutInt64(key string, value int64) error {
 	return <- req.result
 }
 
+// PutBytes puts arbitrary binary value to database under the provided key. This is blocking operation
+func (db *Db) PutBytes(key string, value []byte) error {
+	req := writeRequest{
+		key:    key,
+		value:  append([]byte(nil), value...),
+		result: make(chan error),
+		valueType: typeBytes,
+	}
+
+	db.writeQueue <- req
+
+	return <- req.result
+}
+
+// Delete the key from database. ErrNotFound is returned if the key does not exist.
+// This is blocking operation
+func (db *Db) Delete(key string) error {
+	req := writeRequest{
+		key:    key,
+		result: make(chan error),
+		valueType: typeDelete,
+	}
+
+	db.writeQueue <- req
+
+	return <- req.result
+}
+
 func (db *Db) newSegment() error {
-	n, err := db.lastSegment().number()
+	// The active segment is only changed here, but merge replaces the others.
+	db.RLock()
+	last := db.lastSegment()
+	db.RUnlock()
+
+	n, err := last.number()
 	if err != nil {
 		return err
 	}
@@ -270,11 +586,19 @@ func (db *Db) newSegment() error {
 		return err
 	}
 
+	filter, err := last.seal()
+	if err != nil {
+		return err
+	}
+
 	db.Lock()
+	last.filter = filter
 	db.segments = append(db.segments, seg)
+	db.enforceMemoryBudget()
+	count := len(db.segments)
 	db.Unlock()
 
-	if len(db.segments) > 2 && autoMerge {
+	if count > 2 && autoMerge {
 		go func() {
 			db.mergeQueue <- struct {}{}
 		}()
@@ -284,11 +608,24 @@ func (db *Db) newSegment() error {
 }
 
 func (db *Db) merge() error {
+	db.Lock()
 	segments := db.segments[:len(db.segments) - 1]
+	// Indexes of merged segments are read without the lock, so they are not
+	// moved to disk until the merge is finished.
+	for _, s := range segments {
+		s.merging = true
+	}
+	db.Unlock()
+	defer func() {
+		db.Lock()
+		for _, s := range segments {
+			s.merging = false
+		}
+		db.Unlock()
+	}()
 
-	table := make(map[string]int64)
 	path := filepath.Join(db.outPath, fmt.Sprintf("%s%s", segFileName, "merged"))
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o600)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
 		return err
 	}
@@ -297,50 +634,21 @@ func (db *Db) merge() error {
 		offset: 0,
 		path:  path,
 		file:  f,
-		index: make(hashIndex),
 	}
 
-	for i := len(segments) - 1; i >= 0; i-- {
-		s := segments[i]
-		for k := range s.index {
-			if _, ok := table[k]; ok {
-				continue
-			}
-
-			v, err := s.get(k)
-			if err == ErrWrongType {
-				n, err := s.getInt64(k)
-				if err != nil {
-					seg.close()
-					os.Remove(path)
-					return err
-				}
-
-				table[k] = 1
-
-				err = seg.putInt64(k, n)
-				if err != nil {
-					seg.close()
-					os.Remove(path)
-					return err
-				}
-
-				continue
-			} else if err != nil {
-				seg.close()
-				os.Remove(path)
-				return err
-			}
-
-			table[k] = 1
-
-			err = seg.put(k, v)
-			if err != nil {
-				seg.close()
-				os.Remove(path)
-				return err
-			}
-		}
+	if err := seg.mergeFrom(segments); err != nil {
+		seg.close()
+		os.Remove(path)
+		os.Remove(seg.hintPath())
+		return err
+	}
+	// With the memory budget the index of the merged segment, which is the
+	// oldest one, is left on disk.
+	if err := seg.loadHint(db.memoryBudget > 0); err != nil {
+		seg.close()
+		os.Remove(path)
+		os.Remove(seg.hintPath())
+		return err
 	}
 
 	// DANGER ZONE!
@@ -367,16 +675,126 @@ func (db *Db) merge() error {
 		return err
 	}
 
+	// Stale hint is detected by the segment size and rebuilt on recovery.
 	seg.path = segments[0].path
+	if err := os.Rename(path + hintSuffix, segments[0].hintPath()); err != nil {
+		log.Printf("Cannot replace hint file: %s", err)
+	} else if seg.disk != nil {
+		seg.disk.path = seg.hintPath()
+	}
+
+	seg.file.Close()
 	seg.file = f
+	db.enforceMemoryBudget()
 	db.Unlock()
 
 	for _, s := range segments {
 		s.close()
 		if s != segments[0] {
 			os.Remove(s.path)
+			os.Remove(s.hintPath())
 		}
 	}
 
 	return nil
 }
+
+// mergeFrom writes the latest record of every key of the segments, ordered
+// from the oldest to the newest one, and the hint file of the merged segment.
+// Keys are merged from the sorted indexes of the segments and index entries
+// are written to disk as they go, so the merged index is not kept in memory.
+func (s *segment) mergeFrom(segments []*segment) error {
+	entries, err := ioutil.TempFile(filepath.Dir(s.path), "merge-index-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(entries.Name())
+	defer entries.Close()
+
+	type head struct {
+		key    string
+		offset int64
+		done   bool
+	}
+	iterators := make([]indexIterator, len(segments))
+	heads := make([]head, len(segments))
+	advance := func(i int) error {
+		k, offset, err := iterators[i].next()
+		if err == io.EOF {
+			heads[i] = head{done: true}
+			return nil
+		}
+		heads[i] = head{key: k, offset: offset}
+		return err
+	}
+
+	keys := 0
+	for i, seg := range segments {
+		it, err := seg.sorted()
+		if err != nil {
+			return err
+		}
+		defer it.close()
+		iterators[i] = it
+		if err := advance(i); err != nil {
+			return err
+		}
+		keys += seg.keyCount()
+	}
+
+	filter := newBloomFilter(keys)
+	out := bufio.NewWriter(s.file)
+	index := bufio.NewWriter(entries)
+	count := 0
+	for {
+		// The newest segment having the smallest key has its latest record.
+		latest := -1
+		for i := len(heads) - 1; i >= 0; i-- {
+			if !heads[i].done && (latest == -1 || heads[i].key < heads[latest].key) {
+				latest = i
+			}
+		}
+		if latest == -1 {
+			break
+		}
+		k := heads[latest].key
+
+		// Records are copied as is, so compressed values stay compressed.
+		e, err := segments[latest].entryAt(heads[latest].offset)
+		if err != nil {
+			return err
+		}
+		n, err := out.Write(e.Encode())
+		if err != nil {
+			return err
+		}
+		index.Write(appendUint32(nil, uint32(len(k))))
+		index.WriteString(k)
+		index.Write(appendUint64(nil, uint64(s.offset)))
+		filter.add(k)
+		count++
+		s.offset += int64(n)
+		if e.seq > s.maxSeq {
+			s.maxSeq = e.seq
+		}
+
+		for i := range heads {
+			if !heads[i].done && heads[i].key == k {
+				if err := advance(i); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if err := index.Flush(); err != nil {
+		return err
+	}
+	if _, err := entries.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.writeHint(filter, count, bufio.NewReader(entries))
+}
@@ -1,15 +1,19 @@
 package datastore
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
 )
 
-var testSegSize int64 = 128
+var testSegSize int64 = 192
 
 func TestDb_Put(t *testing.T) {
 	autoMerge = false
@@ -297,3 +301,338 @@ func TestDb_Put(t *testing.T) {
 		}
 	})
 }
+
+func TestDb_Compression(t *testing.T) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSized(dir, testSegSize, WithCompression(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	longVal := strings.Repeat("value", 100)
+	for i := 0; i < 3; i++ {
+		if err := db.Put("long"+strconv.Itoa(i), longVal); err != nil {
+			t.Fatalf("Cannot put long value: %s", err)
+		}
+	}
+	if err := db.Put("short", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, segFileName+"0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= int64(len(longVal)) {
+		t.Errorf("Values were not compressed, segment size %d", info.Size())
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := db.Put("pad"+strconv.Itoa(i), strings.Repeat("x", 40)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.merge(); err != nil {
+		t.Fatalf("Cannot merge: %s", err)
+	}
+
+	e, err := db.segments[0].getEntry("long0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.compressed() {
+		t.Error("Merge must keep records compressed")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDbSized(dir, testSegSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		value, err := db.Get("long" + strconv.Itoa(i))
+		if err != nil {
+			t.Errorf("Cannot get long value: %s", err)
+		}
+		if value != longVal {
+			t.Errorf("Bad value returned: %s", value)
+		}
+	}
+	value, err := db.Get("short")
+	if err != nil || value != "value" {
+		t.Errorf("Bad short value returned: %s, %v", value, err)
+	}
+}
+
+func TestDb_Delete(t *testing.T) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSized(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("key2", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Errorf("Cannot delete key1: %s", err)
+	}
+	if err := db.Delete("key1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+	}
+	if err := db.Delete("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for missing key, got %v", err)
+	}
+	if _, err := db.Get("key1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDbSized(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get("key1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after reopen, got %v", err)
+	}
+	if v, err := db.GetInt64("key2"); err != nil || v != 2 {
+		t.Errorf("Bad value returned for key2: %d, %v", v, err)
+	}
+
+	if err := db.Put("key1", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("key1"); err != nil || v != "again" {
+		t.Errorf("Bad value returned for key1: %s, %v", v, err)
+	}
+}
+
+func TestDb_Bytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := []byte{0, 1, 0xff, '\n'}
+	// Bigger than the read buffer used to scan segments.
+	large := make([]byte, 20000)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+
+	if err := db.PutBytes("small", small); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutBytes("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("str", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetBytes("str"); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+	if _, err := db.Get("small"); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if v, err := db.GetBytes("small"); err != nil || !bytes.Equal(v, small) {
+		t.Errorf("Bad value returned for small: %v, %v", v, err)
+	}
+	if v, err := db.GetBytes("large"); err != nil || !bytes.Equal(v, large) {
+		t.Errorf("Bad value returned for large: %d bytes, %v", len(v), err)
+	}
+	if v, err := db.Get("str"); err != nil || v != "value" {
+		t.Errorf("Bad value returned for str: %s, %v", v, err)
+	}
+}
+
+func TestDb_GetMany(t *testing.T) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSized(dir, testSegSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("str", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("num", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutBytes("bin", []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("deleted", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := db.GetMany([]string{"str", "num", "bin", "deleted", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"str": "value",
+		"num": int64(42),
+		"bin": []byte{1, 2},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Unexpected values %v, expected %v", values, expected)
+	}
+}
+
+// oldRecord encodes the record in the format used before sequence numbers.
+func oldRecord(key string, value []byte, valueType uint16) []byte {
+	kl, vl := len(key), len(value)
+	res := make([]byte, kl+vl+14)
+	binary.LittleEndian.PutUint32(res, uint32(len(res)))
+	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
+	copy(res[8:], key)
+	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
+	binary.LittleEndian.PutUint16(res[kl+12:], valueType)
+	copy(res[kl+14:], value)
+	return res
+}
+
+func TestDb_OldFormat(t *testing.T) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	num := make([]byte, 8)
+	binary.LittleEndian.PutUint64(num, 42)
+	var data []byte
+	data = append(data, oldRecord("str", []byte("old"), typeString)...)
+	data = append(data, oldRecord("num", num, typeInt64)...)
+	data = append(data, oldRecord("str", []byte("value"), typeString)...)
+	data = append(data, oldRecord("gone", []byte("value"), typeString)...)
+	data = append(data, oldRecord("gone", nil, typeDelete)...)
+	if err := ioutil.WriteFile(filepath.Join(dir, segFileName+"0"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDbSized(dir, testSegSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+	}()
+
+	// Old records get sequence numbers in the key order.
+	value, version, err := db.GetWithVersion("str")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" || version != 2 {
+		t.Errorf("Got %v with version %d, expected value with version 2", value, version)
+	}
+	if n, err := db.GetInt64("num"); err != nil || n != 42 {
+		t.Errorf("Got %d, %v, expected 42", n, err)
+	}
+	if _, err := db.Get("gone"); err != ErrNotFound {
+		t.Errorf("Expected deleted key to be missing, got %v", err)
+	}
+	if seq := db.LastSeq(); seq != 2 {
+		t.Errorf("Unexpected last sequence number %d", seq)
+	}
+
+	t.Run("replication", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var events []Event
+		err := db.Changes(ctx, 0, func(e Event) error {
+			events = append(events, e)
+			if len(events) == 2 {
+				cancel()
+			}
+			return nil
+		})
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+		expected := []Event{
+			{Type: EventPut, Key: "num", Value: int64(42), Seq: 1},
+			{Type: EventPut, Key: "str", Value: "value", Seq: 2},
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("Unexpected changes %v", events)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbSized(dir, testSegSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq := db.LastSeq(); seq != 2 {
+			t.Errorf("Old records were sequenced again, last sequence number %d", seq)
+		}
+	})
+
+	// New records are written with sequence numbers next to the old ones.
+	if err := db.Put("str", "new"); err != nil {
+		t.Fatal(err)
+	}
+	value, version, err = db.GetWithVersion("str")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "new" || version != 3 {
+		t.Errorf("Got %v with version %d, expected new with version 3", value, version)
+	}
+}
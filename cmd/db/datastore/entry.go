@@ -2,29 +2,47 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 )
 
 type entry struct {
 	key string
 	value []byte
 	valueType uint16
+	// seq is the sequence number of the write that produced the record.
+	seq uint64
 }
 
+// flagCompressed is set in the value type field of records whose value is
+// stored deflated.
+const flagCompressed uint16 = 1 << 15
+
+// flagSeq is set in the value type field of records having the sequence
+// number. Records written before sequence numbers were added do not have it
+// and are read with zero seq. The flag is only kept on disk.
+const flagSeq uint16 = 1 << 14
+
 var ErrWrongType = fmt.Errorf("wrong value type")
 
+// Record layout: size(4) | keyLen(4) | key | valLen(4) | valueType(2) | seq(8) | value
+// Old records have no seq field and no flagSeq in valueType.
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	size := kl + vl + 14
+	size := kl + vl + 22
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
 	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	binary.LittleEndian.PutUint16(res[kl+12:], e.valueType)
-	copy(res[kl+14:], e.value)
+	binary.LittleEndian.PutUint16(res[kl+12:], e.valueType|flagSeq)
+	binary.LittleEndian.PutUint64(res[kl+14:], e.seq)
+	copy(res[kl+22:], e.value)
 	return res
 }
 
@@ -36,103 +54,114 @@ func (e *entry) Decode(input []byte) {
 
 	vl := binary.LittleEndian.Uint32(input[kl+8:])
 	e.valueType = binary.LittleEndian.Uint16(input[kl+12:kl+14])
+	valueStart := kl + 14
+	e.seq = 0
+	if e.valueType&flagSeq != 0 {
+		e.valueType &^= flagSeq
+		e.seq = binary.LittleEndian.Uint64(input[kl+14:kl+22])
+		valueStart = kl + 22
+	}
 	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+14:kl+14+vl])
+	copy(valBuf, input[valueStart:valueStart+vl])
+	e.value = valBuf
 }
 
-func readStringValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
+func readEntry(in *bufio.Reader) (entry, error) {
+	header, err := in.Peek(4)
 	if err != nil {
-		return "", err
-	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
-		return "", err
+		return entry{}, err
 	}
+	size := int(binary.LittleEndian.Uint32(header))
 
-	header, err = in.Peek(4)
-	if err != nil {
-		return "", err
-	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
+	data := make([]byte, size)
+	_, err = io.ReadFull(in, data)
 	if err != nil {
-		return "", err
+		return entry{}, err
 	}
 
-	header, err = in.Peek(2)
-	if err != nil {
-		return "", err
-	}
+	var e entry
+	e.Decode(data)
+	return e, nil
+}
 
-	valType := binary.LittleEndian.Uint16(header)
-	if valType != typeString {
-		return "", ErrWrongType
-	}
+// kind returns the value type without header flags.
+func (e *entry) kind() uint16 {
+	return e.valueType &^ flagCompressed
+}
 
-	_, err = in.Discard(2)
-	if err != nil {
-		return "", err
+func (e *entry) compressed() bool {
+	return e.valueType&flagCompressed != 0
+}
+
+// compress deflates the value if it is at least threshold bytes long and
+// compression actually makes it smaller. Non-positive threshold disables it.
+func (e *entry) compress(threshold int) error {
+	if threshold <= 0 || len(e.value) < threshold || e.compressed() {
+		return nil
 	}
 
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if _, err := w.Write(e.value); err != nil {
+		return err
 	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	if err := w.Close(); err != nil {
+		return err
 	}
 
-	return string(data), nil
+	if buf.Len() < len(e.value) {
+		e.value = buf.Bytes()
+		e.valueType |= flagCompressed
+	}
+	return nil
 }
 
+// plainValue returns the value bytes, inflating them if the record is compressed.
+func (e *entry) plainValue() ([]byte, error) {
+	if !e.compressed() {
+		return e.value, nil
+	}
 
-func readInt64Value(in *bufio.Reader) (int64, error) {
-	header, err := in.Peek(8)
+	r := flate.NewReader(bytes.NewReader(e.value))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func readStringValue(in *bufio.Reader) (string, error) {
+	e, err := readEntry(in)
 	if err != nil {
-		return 0, err
+		return "", err
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
-		return 0, err
+	if e.kind() != typeString {
+		return "", ErrWrongType
 	}
 
-	header, err = in.Peek(4)
+	data, err := e.plainValue()
 	if err != nil {
-		return 0, err
+		return "", err
 	}
-	valSize := int(binary.LittleEndian.Uint32(header))
 
-	_, err = in.Discard(4)
-	if err != nil {
-		return 0, err
-	}
+	return string(data), nil
+}
 
-	header, err = in.Peek(2)
+func readInt64Value(in *bufio.Reader) (int64, error) {
+	e, err := readEntry(in)
 	if err != nil {
 		return 0, err
 	}
-
-	valType := int(binary.LittleEndian.Uint16(header))
-	if valType != typeInt64 {
+	if e.kind() != typeInt64 {
 		return 0, ErrWrongType
 	}
 
-	_, err = in.Discard(2)
-	if err != nil {
-		return 0, err
-	}
-
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
+	data, err := e.plainValue()
 	if err != nil {
 		return 0, err
 	}
-	if n != valSize {
-		return 0, fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	if len(data) != 8 {
+		return 0, fmt.Errorf("can't read value bytes (read %d, expected %d)", len(data), 8)
 	}
 
 	return int64(binary.LittleEndian.Uint64(data)), nil
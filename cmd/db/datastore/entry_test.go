@@ -9,9 +9,10 @@ import (
 
 func TestEntry_Encode(t *testing.T) {
 	e1 := entry{
-		"key",
-		[]byte("value"),
-		typeString,
+		key:       "key",
+		value:     []byte("value"),
+		valueType: typeString,
+		seq:       7,
 	}
 	e1.Decode(e1.Encode())
 	if e1.key != "key" {
@@ -23,6 +24,9 @@ func TestEntry_Encode(t *testing.T) {
 	if e1.valueType != typeString {
 		t.Error("incorrect type")
 	}
+	if e1.seq != 7 {
+		t.Error("incorrect sequence number")
+	}
 
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, 10)
@@ -96,3 +100,39 @@ func TestReadValue(t *testing.T) {
 		t.Fatalf("Must not parse string with wrong type!")
 	}
 }
+
+func TestEntry_Compress(t *testing.T) {
+	value := bytes.Repeat([]byte("compressible"), 100)
+	e := entry{
+		key:       "key",
+		value:     value,
+		valueType: typeString,
+	}
+	if err := e.compress(len(value) + 1); err != nil {
+		t.Fatal(err)
+	}
+	if e.compressed() {
+		t.Error("Value below threshold must not be compressed")
+	}
+
+	if err := e.compress(64); err != nil {
+		t.Fatal(err)
+	}
+	if !e.compressed() {
+		t.Fatal("Value above threshold must be compressed")
+	}
+	if len(e.value) >= len(value) {
+		t.Errorf("Compressed value is not smaller: %d", len(e.value))
+	}
+	if e.kind() != typeString {
+		t.Errorf("Compression flag leaked into type: %d", e.kind())
+	}
+
+	v, err := readStringValue(bufio.NewReader(bytes.NewReader(e.Encode())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != string(value) {
+		t.Errorf("Got bad decompressed value [%s]", v)
+	}
+}
@@ -0,0 +1,187 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	exportTypeString = "string"
+	exportTypeInt64  = "int64"
+	// Bytes values are exported as base64 strings.
+	exportTypeBytes = "bytes"
+)
+
+var ErrInvalidRecord = fmt.Errorf("invalid import record")
+
+type exportRecord struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Export writes the latest value of every key to w as JSON lines, one
+// {"key","type","value"} object per line, ordered by key. Deleted keys are skipped.
+// Records are read from the snapshot of segments taken when the export starts,
+// so neither writes nor merges wait for the export.
+func (db *Db) Export(w io.Writer) error {
+	latest, files, err := db.snapshot()
+	for _, f := range files {
+		defer f.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(latest))
+	for k := range latest {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	for _, k := range keys {
+		pos := latest[k]
+		e, err := readEntryAt(files[pos.segment], pos.offset)
+		if err != nil {
+			return err
+		}
+
+		if e.kind() == typeDelete {
+			continue
+		}
+
+		rec, err := e.export()
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	return out.Flush()
+}
+
+// Import reads JSON lines in the format produced by Export and puts every
+// record to the database. Malformed records are reported as ErrInvalidRecord
+// with the line number; records before the malformed one are kept.
+func (db *Db) Import(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var rec exportRecord
+		err := decoder.Decode(&rec)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w at line %d: %s", ErrInvalidRecord, line, err)
+		}
+
+		switch rec.Type {
+		case exportTypeString:
+			var v string
+			if err := json.Unmarshal(rec.Value, &v); err != nil {
+				return fmt.Errorf("%w at line %d: %s", ErrInvalidRecord, line, err)
+			}
+			err = db.Put(rec.Key, v)
+		case exportTypeInt64:
+			var v int64
+			if err := json.Unmarshal(rec.Value, &v); err != nil {
+				return fmt.Errorf("%w at line %d: %s", ErrInvalidRecord, line, err)
+			}
+			err = db.PutInt64(rec.Key, v)
+		case exportTypeBytes:
+			var v []byte
+			if err := json.Unmarshal(rec.Value, &v); err != nil {
+				return fmt.Errorf("%w at line %d: %s", ErrInvalidRecord, line, err)
+			}
+			err = db.PutBytes(rec.Key, v)
+		default:
+			return fmt.Errorf("%w at line %d: unknown type %q", ErrInvalidRecord, line, rec.Type)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// recordPos is the position of a record in a segment.
+type recordPos struct {
+	// segment is the number of the segment file in the snapshot.
+	segment int
+	offset  int64
+}
+
+// snapshot returns positions of the latest records of all keys in the segment
+// files opened for reading. The files stay readable after merge replaces them.
+// The files must be closed even if an error is returned.
+func (db *Db) snapshot() (map[string]recordPos, []*os.File, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	latest := make(map[string]recordPos)
+	var files []*os.File
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		s := db.segments[i]
+		f, err := os.Open(s.path)
+		if err != nil {
+			return nil, files, err
+		}
+		files = append(files, f)
+
+		n := len(files) - 1
+		err = s.forEach(func(k string, offset int64) error {
+			if _, ok := latest[k]; !ok {
+				latest[k] = recordPos{segment: n, offset: offset}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, files, err
+		}
+	}
+	return latest, files, nil
+}
+
+func (e *entry) export() (exportRecord, error) {
+	var (
+		value    interface{}
+		typeName string
+	)
+	data, err := e.plainValue()
+	if err != nil {
+		return exportRecord{}, err
+	}
+
+	switch e.kind() {
+	case typeString:
+		typeName = exportTypeString
+		value = string(data)
+	case typeInt64:
+		typeName = exportTypeInt64
+		value = int64(binary.LittleEndian.Uint64(data))
+	case typeBytes:
+		typeName = exportTypeBytes
+		value = data
+	default:
+		return exportRecord{}, ErrWrongType
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return exportRecord{}, err
+	}
+
+	return exportRecord{
+		Key:   e.key,
+		Type:  typeName,
+		Value: raw,
+	}, nil
+}
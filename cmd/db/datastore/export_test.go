@@ -0,0 +1,190 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_ExportImport(t *testing.T) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSized(dir, testSegSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key1", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key2", `quoted "value"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("key3", -42); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", strings.Repeat("new", 50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutBytes("key4", []byte{0, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := db.Export(&out); err != nil {
+		t.Fatalf("Cannot export: %s", err)
+	}
+
+	expected := `{"key":"key1","type":"string","value":"` + strings.Repeat("new", 50) + `"}
+{"key":"key2","type":"string","value":"quoted \"value\""}
+{"key":"key3","type":"int64","value":-42}
+{"key":"key4","type":"bytes","value":"AP8="}
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected export output:\n%s", out.String())
+	}
+
+	t.Run("import", func(t *testing.T) {
+		newDir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(newDir)
+
+		imported, err := NewDbSized(newDir, testSegSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer imported.Close()
+
+		if err := imported.Import(&out); err != nil {
+			t.Fatalf("Cannot import: %s", err)
+		}
+
+		value, err := imported.Get("key2")
+		if err != nil {
+			t.Errorf("Cannot get key2: %s", err)
+		}
+		if value != `quoted "value"` {
+			t.Errorf("Bad value returned for key2: %s", value)
+		}
+		num, err := imported.GetInt64("key3")
+		if err != nil {
+			t.Errorf("Cannot get key3: %s", err)
+		}
+		if num != -42 {
+			t.Errorf("Bad value returned for key3: %d", num)
+		}
+		data, err := imported.GetBytes("key4")
+		if err != nil || !bytes.Equal(data, []byte{0, 0xff}) {
+			t.Errorf("Bad value returned for key4: %v, %v", data, err)
+		}
+	})
+
+	t.Run("invalid import", func(t *testing.T) {
+		for _, input := range []string{
+			`{"key":"a","type":"string","value":1}`,
+			`{"key":"a","type":"int64","value":"1"}`,
+			`{"key":"a","type":"float","value":1.5}`,
+			`{"key":"a"`,
+		} {
+			err := db.Import(strings.NewReader(input))
+			if !errors.Is(err, ErrInvalidRecord) {
+				t.Errorf("Expected ErrInvalidRecord for %s, got %v", input, err)
+			}
+		}
+	})
+}
+
+// blockingWriter blocks writes until unblock is closed.
+type blockingWriter struct {
+	bytes.Buffer
+	writing chan struct{}
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+	<-w.unblock
+	return w.Buffer.Write(p)
+}
+
+func TestDb_ExportConcurrent(t *testing.T) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSized(dir, testSegSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Values are large enough for the export to be written in several parts,
+	// and every record is in its own segment.
+	var expected strings.Builder
+	for i := 0; i < 20; i++ {
+		k := fmt.Sprintf("key%02d", i)
+		v := strings.Repeat(string(rune('a'+i)), 400)
+		if err := db.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&expected, "{\"key\":%q,\"type\":\"string\",\"value\":%q}\n", k, v)
+	}
+
+	w := &blockingWriter{writing: make(chan struct{}, 1), unblock: make(chan struct{})}
+	exported := make(chan error, 1)
+	go func() {
+		exported <- db.Export(w)
+	}()
+	<-w.writing
+
+	// Neither writes nor merges wait for the export in progress.
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := db.Put(fmt.Sprintf("key%02d", i), "new"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- db.merge()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Writes or merge are blocked by the export")
+	}
+
+	// The rest of the records is read from the replaced segment files.
+	close(w.unblock)
+	if err := <-exported; err != nil {
+		t.Fatalf("Cannot export: %s", err)
+	}
+	if w.String() != expected.String() {
+		t.Errorf("Unexpected export output:\n%s", w.String())
+	}
+	if value, err := db.Get("key00"); err != nil || value != "new" {
+		t.Errorf("Bad value after merge: %s, %v", value, err)
+	}
+}
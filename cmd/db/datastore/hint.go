@@ -0,0 +1,179 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const hintSuffix = ".hint"
+
+var ErrBadHint = fmt.Errorf("bad hint file")
+
+// Hint files are written next to every sealed segment. They contain the size
+// of the segment they describe, the segment bloom filter and the segment
+// index sorted by key:
+//
+//	segSize(8) | maxSeq(8) | bloom filter | count(4) | [keyLen(4) | key | offset(8)]...
+func (s *segment) hintPath() string {
+	return s.path + hintSuffix
+}
+
+// seal builds the bloom filter of the segment and stores it with the index
+// into the hint file. The segment must not be written after sealing.
+func (s *segment) seal() (*bloomFilter, error) {
+	filter := newBloomFilter(len(s.index))
+	keys := make([]string, 0, len(s.index))
+	size := 0
+	for k := range s.index {
+		filter.add(k)
+		keys = append(keys, k)
+		size += 4 + len(k) + 8
+	}
+	sort.Strings(keys)
+
+	entries := make([]byte, 0, size)
+	for _, k := range keys {
+		entries = appendUint32(entries, uint32(len(k)))
+		entries = append(entries, k...)
+		entries = appendUint64(entries, uint64(s.index[k]))
+	}
+	if err := s.writeHint(filter, len(keys), bytes.NewReader(entries)); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// writeHint writes the hint file of the segment with count index entries read
+// from entries, which must be sorted by key.
+func (s *segment) writeHint(filter *bloomFilter, count int, entries io.Reader) error {
+	tmp := s.hintPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(f)
+	header := appendUint64(nil, uint64(s.offset))
+	header = appendUint64(header, s.maxSeq)
+	out.Write(header)
+	out.Write(filter.Encode())
+	out.Write(appendUint32(nil, uint32(count)))
+	_, err = io.Copy(out, entries)
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.hintPath())
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// loadHint restores the segment index and bloom filter from its hint file.
+// If spilled is set, the index is left on disk and only its sparse index is
+// kept in memory. ErrBadHint is returned if the hint file does not match the segment.
+func (s *segment) loadHint(spilled bool) error {
+	file, err := os.Open(s.hintPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	in := bufio.NewReader(file)
+	var header [8]byte
+	if _, err := io.ReadFull(in, header[:8]); err != nil {
+		return ErrBadHint
+	}
+	if int64(binary.LittleEndian.Uint64(header[:])) != info.Size() {
+		return ErrBadHint
+	}
+	if _, err := io.ReadFull(in, header[:8]); err != nil {
+		return ErrBadHint
+	}
+	maxSeq := binary.LittleEndian.Uint64(header[:])
+
+	if _, err := io.ReadFull(in, header[:8]); err != nil {
+		return ErrBadHint
+	}
+	words := int(binary.LittleEndian.Uint32(header[4:]))
+	bloom := make([]byte, 8+words*8)
+	copy(bloom, header[:8])
+	if _, err := io.ReadFull(in, bloom[8:]); err != nil {
+		return ErrBadHint
+	}
+	filter := new(bloomFilter)
+	if _, err := filter.Decode(bloom); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(in, header[:4]); err != nil {
+		return ErrBadHint
+	}
+	count := int(binary.LittleEndian.Uint32(header[:]))
+	pos := int64(8 + 8 + len(bloom) + 4)
+
+	var (
+		index hashIndex
+		disk  *sortedIndex
+	)
+	if spilled {
+		disk = &sortedIndex{path: s.hintPath()}
+	} else {
+		index = make(hashIndex, count)
+	}
+	for i := 0; i < count; i++ {
+		key, offset, err := readIndexEntry(in)
+		if err != nil {
+			return ErrBadHint
+		}
+
+		if spilled {
+			if i%sparseInterval == 0 {
+				disk.sparse = append(disk.sparse, sparseEntry{key: key, pos: pos})
+			}
+		} else {
+			index[key] = offset
+		}
+		pos += int64(4 + len(key) + 8)
+	}
+
+	if spilled {
+		disk.end = pos
+		disk.count = count
+	}
+	s.index = index
+	s.disk = disk
+	s.offset = info.Size()
+	s.filter = filter
+	s.maxSeq = maxSeq
+	s.legacy = maxSeq == 0 && count > 0
+	return nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,268 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+// sparseInterval is the number of index entries between two keys of a sparse index.
+const sparseInterval = 32
+
+// indexEntryOverhead approximates the memory used by a hashIndex entry besides the key.
+const indexEntryOverhead = 48
+
+type sparseEntry struct {
+	key string
+	pos int64
+}
+
+// sortedIndex is the on-disk index of a sealed segment. Index entries are
+// stored sorted by key in the hint file, and only every sparseInterval-th key
+// with its position in the file is kept in memory.
+type sortedIndex struct {
+	path   string
+	end    int64
+	count  int
+	sparse []sparseEntry
+}
+
+func (idx *sortedIndex) lookup(key string) (int64, error) {
+	i := sort.Search(len(idx.sparse), func(i int) bool {
+		return idx.sparse[i].key > key
+	}) - 1
+	if i < 0 {
+		return 0, ErrNotFound
+	}
+
+	start := idx.sparse[i].pos
+	end := idx.end
+	if i+1 < len(idx.sparse) {
+		end = idx.sparse[i+1].pos
+	}
+
+	file, err := os.Open(idx.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	block := make([]byte, end-start)
+	if _, err := file.ReadAt(block, start); err != nil {
+		return 0, err
+	}
+
+	for len(block) > 0 {
+		k, offset, n, err := decodeIndexEntry(block)
+		if err != nil {
+			return 0, err
+		}
+		if k == key {
+			return offset, nil
+		} else if k > key {
+			break
+		}
+		block = block[n:]
+	}
+
+	return 0, ErrNotFound
+}
+
+func (idx *sortedIndex) forEach(fn func(key string, offset int64) error) error {
+	if len(idx.sparse) == 0 {
+		return nil
+	}
+
+	file, err := os.Open(idx.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	start := idx.sparse[0].pos
+	in := bufio.NewReader(io.NewSectionReader(file, start, idx.end-start))
+	for {
+		key, offset, err := readIndexEntry(in)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(key, offset); err != nil {
+			return err
+		}
+	}
+}
+
+func (idx *sortedIndex) iterator() (indexIterator, error) {
+	if len(idx.sparse) == 0 {
+		return new(memIterator), nil
+	}
+
+	file, err := os.Open(idx.path)
+	if err != nil {
+		return nil, err
+	}
+
+	start := idx.sparse[0].pos
+	return &diskIterator{
+		file: file,
+		in:   bufio.NewReader(io.NewSectionReader(file, start, idx.end-start)),
+	}, nil
+}
+
+func (idx *sortedIndex) memSize() int64 {
+	var size int64
+	for _, e := range idx.sparse {
+		size += int64(len(e.key)) + indexEntryOverhead
+	}
+	return size
+}
+
+// lookup returns the offset of the key record in the segment.
+func (s *segment) lookup(key string) (int64, error) {
+	if s.index == nil {
+		return s.disk.lookup(key)
+	}
+
+	position, ok := s.index[key]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return position, nil
+}
+
+// forEach calls fn for every key of the segment with its record offset.
+func (s *segment) forEach(fn func(key string, offset int64) error) error {
+	if s.index == nil {
+		return s.disk.forEach(fn)
+	}
+
+	for k, offset := range s.index {
+		if err := fn(k, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyCount returns the number of keys in the segment index.
+func (s *segment) keyCount() int {
+	if s.index == nil {
+		return s.disk.count
+	}
+	return len(s.index)
+}
+
+// indexIterator iterates over index entries ordered by key.
+type indexIterator interface {
+	// next returns the next key with its record offset, or io.EOF.
+	next() (string, int64, error)
+	close() error
+}
+
+// sorted returns the iterator over the segment index ordered by key.
+func (s *segment) sorted() (indexIterator, error) {
+	if s.index == nil {
+		return s.disk.iterator()
+	}
+
+	keys := make([]string, 0, len(s.index))
+	for k := range s.index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return &memIterator{index: s.index, keys: keys}, nil
+}
+
+type memIterator struct {
+	index hashIndex
+	keys  []string
+}
+
+func (it *memIterator) next() (string, int64, error) {
+	if len(it.keys) == 0 {
+		return "", 0, io.EOF
+	}
+	k := it.keys[0]
+	it.keys = it.keys[1:]
+	return k, it.index[k], nil
+}
+
+func (it *memIterator) close() error {
+	return nil
+}
+
+type diskIterator struct {
+	file *os.File
+	in   *bufio.Reader
+}
+
+func (it *diskIterator) next() (string, int64, error) {
+	return readIndexEntry(it.in)
+}
+
+func (it *diskIterator) close() error {
+	return it.file.Close()
+}
+
+// memSize estimates the memory used by the segment index.
+func (s *segment) memSize() int64 {
+	if s.index == nil {
+		return s.disk.memSize()
+	}
+
+	var size int64
+	for k := range s.index {
+		size += int64(len(k)) + indexEntryOverhead
+	}
+	return size
+}
+
+// spill replaces the in-memory index of a sealed segment with the sorted
+// index from its hint file.
+func (s *segment) spill() error {
+	spilled := &segment{path: s.path}
+	if err := spilled.loadHint(true); err != nil {
+		return err
+	}
+
+	s.disk = spilled.disk
+	s.index = nil
+	return nil
+}
+
+func decodeIndexEntry(input []byte) (string, int64, int, error) {
+	if len(input) < 4 {
+		return "", 0, 0, ErrBadHint
+	}
+	kl := int(binary.LittleEndian.Uint32(input))
+	if len(input) < 4+kl+8 {
+		return "", 0, 0, ErrBadHint
+	}
+
+	key := string(input[4 : 4+kl])
+	offset := int64(binary.LittleEndian.Uint64(input[4+kl:]))
+	return key, offset, 4 + kl + 8, nil
+}
+
+func readIndexEntry(in *bufio.Reader) (string, int64, error) {
+	header, err := in.Peek(4)
+	if err == io.EOF && len(header) == 0 {
+		return "", 0, io.EOF
+	} else if err != nil {
+		return "", 0, ErrBadHint
+	}
+	kl := int(binary.LittleEndian.Uint32(header))
+
+	data := make([]byte, 4+kl+8)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return "", 0, ErrBadHint
+	}
+
+	key, offset, _, err := decodeIndexEntry(data)
+	return key, offset, err
+}
@@ -0,0 +1,157 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestDb_MemoryBudget(t *testing.T) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const keys = 1000
+	db, err := NewDbSized(dir, 4096, WithMemoryBudget(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(t *testing.T, db *Db) {
+		if len(db.segments) < 3 {
+			t.Fatalf("Expected several segments, got %d", len(db.segments))
+		}
+		if db.segments[0].index != nil {
+			t.Error("Oldest segment index was not moved to disk")
+		}
+		if db.lastSegment().index == nil {
+			t.Error("Active segment index must stay in memory")
+		}
+
+		for i := 0; i < keys; i++ {
+			value, err := db.Get("key" + strconv.Itoa(i))
+			if err != nil {
+				t.Fatalf("Cannot get key%d: %s", i, err)
+			}
+			if value != "value"+strconv.Itoa(i) {
+				t.Errorf("Bad value returned expected value%d, got %s", i, value)
+			}
+		}
+		for _, k := range []string{"", "a", "key", "key5000", "zzz"} {
+			if _, err := db.Get(k); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for %q, got %v", k, err)
+			}
+		}
+	}
+
+	t.Run("spilled", func(t *testing.T) {
+		check(t, db)
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbSized(dir, 4096, WithMemoryBudget(1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+
+		// Indexes are loaded within the budget.
+		var used int64
+		for _, s := range db.segments[:len(db.segments)-1] {
+			if s.index != nil {
+				used += s.memSize()
+			}
+		}
+		if used > 1024 {
+			t.Errorf("Recovered indexes use %d bytes", used)
+		}
+
+		// Indexes over the budget are not loaded to memory at all.
+		seg, err := openSealedSegment(db.segments[0].path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer seg.close()
+		if seg.index != nil || seg.disk == nil {
+			t.Error("Index of the opened segment was loaded to memory")
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		for i := 0; i < keys; i += 10 {
+			if err := db.Put("key"+strconv.Itoa(i), "new"+strconv.Itoa(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Delete("key1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.newSegment(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.merge(); err != nil {
+			t.Fatalf("Cannot merge: %s", err)
+		}
+		if len(db.segments) != 2 {
+			t.Errorf("Unexpected number of segments after merge: %d", len(db.segments))
+		}
+		if db.segments[0].index != nil {
+			t.Error("Merged segment index was not left on disk")
+		}
+		for i := 0; i < keys; i++ {
+			expected := "value" + strconv.Itoa(i)
+			if i%10 == 0 {
+				expected = "new" + strconv.Itoa(i)
+			}
+			value, err := db.Get("key" + strconv.Itoa(i))
+			if i == 1 {
+				if err != ErrNotFound {
+					t.Errorf("Expected deleted key1 to be missing, got %v", err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Cannot get key%d: %s", i, err)
+			}
+			if value != expected {
+				t.Errorf("Bad value returned expected %s, got %s", expected, value)
+			}
+		}
+	})
+
+	// Segments being merged keep their indexes while new segments are added.
+	t.Run("concurrent merge", func(t *testing.T) {
+		merged := make(chan error, 1)
+		go func() {
+			merged <- db.merge()
+		}()
+		for i := 0; i < keys; i++ {
+			if err := db.Put("other"+strconv.Itoa(i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-merged; err != nil {
+			t.Fatalf("Cannot merge: %s", err)
+		}
+		if value, err := db.Get("key2"); err != nil || value != "value2" {
+			t.Errorf("Bad value returned for key2: %s, %v", value, err)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
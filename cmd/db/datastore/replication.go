@@ -0,0 +1,219 @@
+package datastore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+)
+
+var ErrChangesLost = fmt.Errorf("changes were lost, follow again from the last applied sequence number")
+
+// LastSeq returns the sequence number of the last write.
+func (db *Db) LastSeq() uint64 {
+	db.RLock()
+	defer db.RUnlock()
+	return db.seq
+}
+
+// Changes calls fn with every change that has sequence number greater than
+// since, in the sequence number order, and then with every new change until
+// ctx is done or fn returns an error. Only the latest change of every key is
+// reported for already written records. ErrChangesLost is returned if fn is
+// too slow to keep up with the writes or the database is closed.
+func (db *Db) Changes(ctx context.Context, since uint64, fn func(Event) error) error {
+	// Watch before reading the records, so writes made meanwhile are not
+	// missed. Events that are already in the snapshot are skipped by seq.
+	w := db.Watch("")
+	defer w.Close()
+
+	snapshot, err := db.changesSince(since)
+	if err != nil {
+		return err
+	}
+	for _, e := range snapshot {
+		if err := fn(e); err != nil {
+			return err
+		}
+		since = e.Seq
+	}
+
+	for {
+		select {
+		case e, ok := <-w.C:
+			if !ok {
+				return ErrChangesLost
+			}
+			if e.Seq <= since {
+				continue
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+			since = e.Seq
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sequenceLegacy writes again the latest records of keys written before
+// sequence numbers were added, so that they get sequence numbers and are
+// replicated like any other change.
+func (db *Db) sequenceLegacy() error {
+	keys := make(map[string]struct{})
+	db.RLock()
+	for _, s := range db.segments {
+		if !s.legacy {
+			continue
+		}
+		err := s.forEach(func(k string, _ int64) error {
+			keys[k] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			db.RUnlock()
+			return err
+		}
+	}
+	db.RUnlock()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// Keys are sequenced in a stable order.
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	written := 0
+	for _, k := range sorted {
+		db.RLock()
+		e, err := db.find(k)
+		db.RUnlock()
+		if err == ErrNotFound || (err == nil && e.seq != 0) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		event, err := e.event()
+		if err != nil {
+			return err
+		}
+		valueType, err := valueTypeOf(event.Value)
+		if err != nil {
+			return err
+		}
+		req := writeRequest{
+			key:       k,
+			value:     event.Value,
+			valueType: valueType,
+			result:    make(chan error),
+		}
+		db.writeQueue <- req
+		if err := <-req.result; err != nil {
+			return err
+		}
+		written++
+	}
+	log.Printf("Assigned sequence numbers to %d records written before them", written)
+	return nil
+}
+
+func (db *Db) changesSince(since uint64) ([]Event, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	seen := make(map[string]struct{})
+	var events []Event
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		s := db.segments[i]
+		err := s.forEach(func(k string, offset int64) error {
+			if _, ok := seen[k]; ok {
+				return nil
+			}
+			seen[k] = struct{}{}
+
+			e, err := s.entryAt(offset)
+			if err != nil {
+				return err
+			}
+			if e.seq <= since {
+				return nil
+			}
+
+			event, err := e.event()
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Seq < events[j].Seq
+	})
+	return events, nil
+}
+
+// Apply writes the change received from another database keeping its sequence
+// number. Changes with sequence numbers that are not greater than LastSeq are ignored.
+// This is blocking operation
+func (db *Db) Apply(e Event) error {
+	if e.Seq == 0 {
+		return fmt.Errorf("change of %s has no sequence number", e.Key)
+	}
+
+	req := writeRequest{
+		key:    e.Key,
+		value:  e.Value,
+		seq:    e.Seq,
+		result: make(chan error),
+	}
+	if e.Type == EventDelete {
+		req.valueType = typeDelete
+		req.value = nil
+	} else {
+		valueType, err := valueTypeOf(e.Value)
+		if err != nil {
+			return err
+		}
+		req.valueType = valueType
+	}
+
+	db.writeQueue <- req
+
+	return <-req.result
+}
+
+func (e *entry) event() (Event, error) {
+	if e.kind() == typeDelete {
+		return Event{Type: EventDelete, Key: e.key, Seq: e.seq}, nil
+	}
+
+	data, err := e.plainValue()
+	if err != nil {
+		return Event{}, err
+	}
+
+	event := Event{Type: EventPut, Key: e.key, Seq: e.seq}
+	switch e.kind() {
+	case typeString:
+		event.Value = string(data)
+	case typeInt64:
+		event.Value = int64(binary.LittleEndian.Uint64(data))
+	case typeBytes:
+		event.Value = data
+	default:
+		return Event{}, ErrWrongType
+	}
+	return event, nil
+}
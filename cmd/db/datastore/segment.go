@@ -19,7 +19,18 @@ type segment struct {
 	path   string
 	file   *os.File
 	offset int64
-	index  hashIndex
+	// index is nil if the segment index is kept on disk.
+	index hashIndex
+	disk  *sortedIndex
+	// filter is only built for sealed segments.
+	filter *bloomFilter
+	// maxSeq is the highest sequence number of the segment records.
+	maxSeq uint64
+	// merging is set while the segment is being merged.
+	merging bool
+	// legacy is set if the segment has records written before sequence
+	// numbers were added.
+	legacy bool
 }
 
 const bufSize = 8192
@@ -53,7 +64,7 @@ func (s *segment) recover() error {
 		} else {
 			data = make([]byte, size)
 		}
-		n, err = in.Read(data)
+		n, err = io.ReadFull(in, data)
 
 		if err == nil {
 			if n != int(size) {
@@ -64,6 +75,12 @@ func (s *segment) recover() error {
 			e.Decode(data)
 			s.index[e.key] = s.offset
 			s.offset += int64(n)
+			if e.seq > s.maxSeq {
+				s.maxSeq = e.seq
+			}
+			if e.seq == 0 {
+				s.legacy = true
+			}
 		}
 	}
 	return err
@@ -73,96 +90,60 @@ func (s *segment) close() error {
 	return s.file.Close()
 }
 
-func (s *segment) put(key, value string) error {
-	e := entry{
-		key:   key,
-		value: []byte(value),
-		valueType: typeString,
-	}
+func (s *segment) write(e entry) error {
 	n, err := s.file.Write(e.Encode())
 	if err == nil {
-		s.index[key] = s.offset
+		s.index[e.key] = s.offset
 		s.offset += int64(n)
+		if e.seq > s.maxSeq {
+			s.maxSeq = e.seq
+		}
 	}
 	return err
 }
 
-func (s *segment) putInt64(key string, value int64) error {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(value))
-	e := entry{
-		key:   key,
-		value: b,
-		valueType: typeInt64,
-	}
-	n, err := s.file.Write(e.Encode())
-	if err == nil {
-		s.index[key] = s.offset
-		s.offset += int64(n)
-	}
-	return err
-}
+func (s *segment) number() (int, error) {
+	name := s.file.Name()
+	i := strings.Index(name, segFileName)
 
-func (s *segment) get(key string) (string, error) {
-	position, ok := s.index[key]
-	if !ok {
-		return "", ErrNotFound
+	if i == -1 {
+		return 0, SegmentCorrupted
 	}
 
-	file, err := os.Open(s.path)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
+	num := name[i + len(segFileName):]
+	return strconv.Atoi(num)
+}
 
-	_, err = file.Seek(position, 0)
-	if err != nil {
-		return "", err
-	}
+// mayContain reports whether the key can be present in the segment.
+func (s *segment) mayContain(h bloomKey) bool {
+	return s.filter == nil || s.filter.mayContain(h)
+}
 
-	reader := bufio.NewReader(file)
-	value, err := readStringValue(reader)
+func (s *segment) getEntry(key string) (entry, error) {
+	position, err := s.lookup(key)
 	if err != nil {
-		return "", err
+		return entry{}, err
 	}
 
-	return value, nil
+	return s.entryAt(position)
 }
 
-func (s *segment) getInt64(key string) (int64, error) {
-	position, ok := s.index[key]
-	if !ok {
-		return 0, ErrNotFound
-	}
-
+func (s *segment) entryAt(position int64) (entry, error) {
 	file, err := os.Open(s.path)
 	if err != nil {
-		return 0, err
+		return entry{}, err
 	}
 	defer file.Close()
 
-	_, err = file.Seek(position, 0)
-	if err != nil {
-		return 0, err
-	}
-
-	reader := bufio.NewReader(file)
-	value, err := readInt64Value(reader)
-	if err != nil {
-		return 0, err
-	}
-
-	return value, nil
+	return readEntryAt(file, position)
 }
 
-func (s *segment) number() (int, error) {
-	name := s.file.Name()
-	i := strings.Index(name, segFileName)
-
-	if i == -1 {
-		return 0, SegmentCorrupted
+// readEntryAt reads the record at the position of the segment file.
+func readEntryAt(file *os.File, position int64) (entry, error) {
+	_, err := file.Seek(position, 0)
+	if err != nil {
+		return entry{}, err
 	}
 
-	num := name[i + len(segFileName):]
-	return strconv.Atoi(num)
+	return readEntry(bufio.NewReader(file))
 }
@@ -0,0 +1,97 @@
+package datastore
+
+import "fmt"
+
+// ErrVersionMismatch is returned by conditional writes if the key has another version.
+var ErrVersionMismatch = fmt.Errorf("record version does not match")
+
+// GetWithVersion returns the value of the key, which is string, int64 or []byte,
+// and its version. The version is the sequence number of the write that set
+// the value, so it grows with every change of the key.
+func (db *Db) GetWithVersion(key string) (interface{}, uint64, error) {
+	db.RLock()
+	defer db.RUnlock()
+	e, err := db.find(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	event, err := e.event()
+	if err != nil {
+		return nil, 0, err
+	}
+	return event.Value, e.seq, nil
+}
+
+// PutIfVersion puts string, int64 or []byte value only if the key currently has
+// the version, otherwise ErrVersionMismatch is returned. Version 0 means that
+// the key must not exist. This is blocking operation
+func (db *Db) PutIfVersion(key string, value interface{}, version uint64) error {
+	valueType, err := valueTypeOf(value)
+	if err != nil {
+		return err
+	}
+	if b, ok := value.([]byte); ok {
+		value = append([]byte(nil), b...)
+	}
+
+	req := writeRequest{
+		key:       key,
+		value:     value,
+		valueType: valueType,
+		ifVersion: &version,
+		result:    make(chan error),
+	}
+
+	db.writeQueue <- req
+
+	return <-req.result
+}
+
+// DeleteIfVersion deletes the key only if it currently has the version,
+// otherwise ErrVersionMismatch is returned. This is blocking operation
+func (db *Db) DeleteIfVersion(key string, version uint64) error {
+	req := writeRequest{
+		key:       key,
+		valueType: typeDelete,
+		ifVersion: &version,
+		result:    make(chan error),
+	}
+
+	db.writeQueue <- req
+
+	return <-req.result
+}
+
+// checkVersion returns ErrVersionMismatch if the key does not have the version.
+// Missing keys have version 0.
+func (db *Db) checkVersion(key string, version uint64) error {
+	db.RLock()
+	defer db.RUnlock()
+
+	var current uint64
+	e, err := db.find(key)
+	if err == nil {
+		current = e.seq
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	if current != version {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+func valueTypeOf(value interface{}) (int, error) {
+	switch value.(type) {
+	case string:
+		return typeString, nil
+	case int64:
+		return typeInt64, nil
+	case []byte:
+		return typeBytes, nil
+	default:
+		return 0, ErrWrongType
+	}
+}
@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Version(t *testing.T) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSized(dir, testSegSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := db.GetWithVersion("key"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := db.PutIfVersion("key", "first", 1); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch for missing key, got %v", err)
+	}
+	if err := db.PutIfVersion("key", "first", 0); err != nil {
+		t.Fatalf("Cannot create key: %s", err)
+	}
+	if err := db.PutIfVersion("key", "again", 0); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch for existing key, got %v", err)
+	}
+
+	v, version, err := db.GetWithVersion("key")
+	if err != nil || v != "first" {
+		t.Fatalf("Bad value returned: %v, %v", v, err)
+	}
+
+	if err := db.PutInt64("other", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, otherVersion, _ := db.GetWithVersion("other"); otherVersion <= version {
+		t.Errorf("Version %d is not greater than %d", otherVersion, version)
+	}
+
+	if err := db.PutIfVersion("key", int64(2), version); err != nil {
+		t.Fatalf("Cannot update key: %s", err)
+	}
+	if err := db.PutIfVersion("key", int64(3), version); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch for stale version, got %v", err)
+	}
+	if err := db.PutIfVersion("key", 3.5, 0); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+
+	v, version, err = db.GetWithVersion("key")
+	if err != nil || v != int64(2) {
+		t.Fatalf("Bad value returned: %v, %v", v, err)
+	}
+
+	if err := db.DeleteIfVersion("key", version-1); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch for stale version, got %v", err)
+	}
+	if err := db.DeleteIfVersion("key", 0); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch for zero version, got %v", err)
+	}
+	if err := db.DeleteIfVersion("missing", 0); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for missing key, got %v", err)
+	}
+	if err := db.DeleteIfVersion("key", version); err != nil {
+		t.Fatalf("Cannot delete key: %s", err)
+	}
+
+	// Versions survive restarts.
+	if err := db.PutIfVersion("key", []byte{1}, 0); err != nil {
+		t.Fatalf("Cannot create deleted key: %s", err)
+	}
+	_, version, _ = db.GetWithVersion("key")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDbSized(dir, testSegSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, reopened, err := db.GetWithVersion("key"); err != nil || reopened != version {
+		t.Errorf("Bad version after reopen: %d, %v, expected %d", reopened, err, version)
+	}
+}
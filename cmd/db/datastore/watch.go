@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"strings"
+)
+
+// watchBuffer is the number of events a watcher may lag behind the writer.
+const watchBuffer = 256
+
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// Event describes a change of a key. Value is string, int64 or []byte for
+// puts and nil for deletes.
+type Event struct {
+	Type  EventType   `json:"type"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+	Seq   uint64      `json:"seq"`
+}
+
+// Watcher receives events about changes of keys with the watched prefix.
+// C is closed when the watcher or the database is closed, or when the watcher
+// falls more than watchBuffer events behind; in the latter case the client
+// should watch again and re-read the keys it is interested in.
+type Watcher struct {
+	C      <-chan Event
+	ch     chan Event
+	prefix string
+	db     *Db
+}
+
+// Watch subscribes to changes of keys starting with prefix.
+// Empty prefix watches the whole keyspace.
+func (db *Db) Watch(prefix string) *Watcher {
+	ch := make(chan Event, watchBuffer)
+	w := &Watcher{
+		C:      ch,
+		ch:     ch,
+		prefix: prefix,
+		db:     db,
+	}
+
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if db.closed {
+		close(ch)
+	} else {
+		db.watchers[w] = struct{}{}
+	}
+	return w
+}
+
+// Close stops delivering events to the watcher.
+func (w *Watcher) Close() {
+	w.db.watchMu.Lock()
+	defer w.db.watchMu.Unlock()
+	if _, ok := w.db.watchers[w]; ok {
+		delete(w.db.watchers, w)
+		close(w.ch)
+	}
+}
+
+func (db *Db) publish(e Event) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for w := range db.watchers {
+		if !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+
+		select {
+		case w.ch <- e:
+		default:
+			delete(db.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+// closeWatchers marks the database closed and closes all watchers.
+func (db *Db) closeWatchers() {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	db.closed = true
+	for w := range db.watchers {
+		delete(db.watchers, w)
+		close(w.ch)
+	}
+}
+
+func eventType(valueType int) EventType {
+	if valueType == typeDelete {
+		return EventDelete
+	}
+	return EventPut
+}
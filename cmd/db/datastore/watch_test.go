@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Watch(t *testing.T) {
+	autoMerge = false
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSized(dir, testSegSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := db.Watch("user/")
+	all := db.Watch("")
+
+	if err := db.Put("user/1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("counter", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Event{
+		{Type: EventPut, Key: "user/1", Value: "alice", Seq: 1},
+		{Type: EventDelete, Key: "user/1", Seq: 3},
+	}
+	for _, e := range expected {
+		if got := <-users.C; !reflect.DeepEqual(got, e) {
+			t.Errorf("Unexpected event %+v, expected %+v", got, e)
+		}
+	}
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		if got := <-all.C; got.Seq != seq {
+			t.Errorf("Unexpected event %+v, expected seq %d", got, seq)
+		}
+	}
+
+	users.Close()
+	if _, ok := <-users.C; ok {
+		t.Error("Closed watcher must not receive events")
+	}
+
+	t.Run("slow watcher", func(t *testing.T) {
+		slow := db.Watch("")
+		for i := 0; i <= watchBuffer; i++ {
+			if err := db.PutInt64("counter", int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n := 0
+		for range slow.C {
+			n++
+		}
+		if n != watchBuffer {
+			t.Errorf("Expected %d buffered events, got %d", watchBuffer, n)
+		}
+	})
+
+	t.Run("sequence recovery", func(t *testing.T) {
+		w := db.Watch("")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := <-w.C; ok {
+			t.Error("Watchers must be closed with database")
+		}
+
+		db, err = NewDbSized(dir, testSegSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		w = db.Watch("")
+		if err := db.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if e := <-w.C; e.Seq != 3+watchBuffer+2 {
+			t.Errorf("Sequence number was not recovered, got %d", e.Seq)
+		}
+	})
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/cmd/db/datastore"
+)
+
+const keyPrefix = "/db/"
+
+const octetStream = "application/octet-stream"
+
+// Error codes sent in error bodies.
+const (
+	codeNotFound         = "not_found"
+	codeBadRequest       = "bad_request"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeNotAcceptable    = "not_acceptable"
+	codePrecondition     = "precondition_failed"
+	codeReadOnly         = "read_only"
+	codeTooLarge         = "request_too_large"
+	codeInternal         = "internal_error"
+)
+
+// maxGetManyBody limits the size of multi-get request bodies.
+const maxGetManyBody = 1 << 20
+
+var errBodyTooLarge = errors.New("request body is too large")
+
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// valueResponse is the JSON body of GET /db/{key}. Type is "string", "int64"
+// or "bytes", bytes values are base64 encoded.
+type valueResponse struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// handler serves the db HTTP API:
+//
+//	GET, HEAD, PUT, POST, DELETE /db/{key}
+//	GET /db/watch?prefix=
+//	POST /db/_mget
+//	GET /admin/export, POST /admin/import
+//	GET /replication/stream?since=
+//
+// Replicas are read-only and reject writes with 403. Values have an ETag with
+// their version, which writes may check with If-Match and If-None-Match.
+type handler struct {
+	db       *datastore.Db
+	readOnly bool
+	mux      *http.ServeMux
+	// shutdown is cancelled by stopStreams to finish streaming responses.
+	shutdown    context.Context
+	stopStreams context.CancelFunc
+}
+
+type methodHandlers map[string]http.HandlerFunc
+
+func newHandler(db *datastore.Db, readOnly bool) *handler {
+	h := &handler{
+		db:       db,
+		readOnly: readOnly,
+		mux:      new(http.ServeMux),
+	}
+	h.shutdown, h.stopStreams = context.WithCancel(context.Background())
+
+	h.mux.Handle(keyPrefix, methodHandlers{
+		http.MethodGet:    h.get,
+		http.MethodHead:   h.head,
+		http.MethodPut:    h.put,
+		http.MethodPost:   h.put,
+		http.MethodDelete: h.delete,
+	})
+	h.mux.Handle(keyPrefix+"watch", methodHandlers{
+		http.MethodGet: h.watch,
+	})
+	h.mux.Handle(keyPrefix+"_mget", methodHandlers{
+		http.MethodPost: h.getMany,
+	})
+	h.mux.Handle("/admin/export", methodHandlers{
+		http.MethodGet: h.export,
+	})
+	h.mux.Handle("/admin/import", methodHandlers{
+		http.MethodPost: h.importRecords,
+	})
+	h.mux.Handle(replicationPath, methodHandlers{
+		http.MethodGet: replicationHandler(db, h.shutdown),
+	})
+	return h
+}
+
+func (h *handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(rw, r)
+}
+
+func (m methodHandlers) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if f, ok := m[r.Method]; ok {
+		f(rw, r)
+		return
+	}
+
+	allowed := make([]string, 0, len(m))
+	for method := range m {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	rw.Header().Set("allow", strings.Join(allowed, ", "))
+	writeError(rw, http.StatusMethodNotAllowed, codeMethodNotAllowed,
+		fmt.Sprintf("method %s is not allowed", r.Method))
+}
+
+// streamContext returns the context of a streaming response, which is done
+// when the client disconnects or the server shuts down.
+func streamContext(r *http.Request, shutdown context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-shutdown.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func writeError(rw http.ResponseWriter, status int, code, message string) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(errorResponse{Code: code, Message: message}); err != nil {
+		log.Printf("Failed to write error response: %s", err)
+	}
+}
+
+func writeDbError(rw http.ResponseWriter, err error) {
+	if err == datastore.ErrNotFound {
+		writeError(rw, http.StatusNotFound, codeNotFound, err.Error())
+	} else if err == datastore.ErrVersionMismatch {
+		writeError(rw, http.StatusPreconditionFailed, codePrecondition, err.Error())
+	} else {
+		writeError(rw, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
+
+// readBody reads the request body of at most limit bytes. errBodyTooLarge is
+// returned for larger bodies.
+func readBody(rw http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, limit))
+	if err != nil && int64(len(body)) == limit {
+		return nil, errBodyTooLarge
+	}
+	return body, err
+}
+
+// key returns the URL-decoded key from /db/{key} path.
+func key(r *http.Request) (string, error) {
+	k, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), keyPrefix))
+	if err != nil {
+		return "", err
+	}
+	if k == "" {
+		return "", errors.New("empty key")
+	}
+	return k, nil
+}
+
+func (h *handler) checkWritable(rw http.ResponseWriter) bool {
+	if h.readOnly {
+		writeError(rw, http.StatusForbidden, codeReadOnly, "replica is read-only")
+		return false
+	}
+	return true
+}
+
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// matchETag reports whether If-Match or If-None-Match header value matches the
+// version. Missing keys match nothing.
+func matchETag(header string, version uint64, exists bool) bool {
+	if !exists {
+		return false
+	}
+	tag := etag(version)
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "*" || part == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// precondition evaluates If-Match and If-None-Match headers of a write. It
+// returns the version the write must be applied to, conditional is false if
+// the request has no conditions. ErrVersionMismatch is returned if the
+// conditions do not hold.
+func (h *handler) precondition(r *http.Request, k string) (version uint64, conditional bool, err error) {
+	ifMatch := r.Header.Get("if-match")
+	ifNoneMatch := r.Header.Get("if-none-match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return 0, false, nil
+	}
+
+	_, version, err = h.db.GetWithVersion(k)
+	exists := err == nil
+	if err != nil && err != datastore.ErrNotFound {
+		return 0, true, err
+	}
+
+	if ifMatch != "" && !matchETag(ifMatch, version, exists) {
+		return 0, true, datastore.ErrVersionMismatch
+	}
+	if ifNoneMatch != "" && matchETag(ifNoneMatch, version, exists) {
+		return 0, true, datastore.ErrVersionMismatch
+	}
+	return version, true, nil
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case int64:
+		return "int64"
+	case []byte:
+		return "bytes"
+	default:
+		return "string"
+	}
+}
+
+// acceptsRaw reports whether the client asked for the raw value with
+// Accept: application/octet-stream.
+func acceptsRaw(r *http.Request) bool {
+	for _, accept := range r.Header.Values("accept") {
+		for _, part := range strings.Split(accept, ",") {
+			if t, _, err := mime.ParseMediaType(part); err == nil && t == octetStream {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeRaw sends string and bytes values as is. Integers have no raw form.
+func writeRaw(rw http.ResponseWriter, v interface{}) {
+	var data []byte
+	switch v := v.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		writeError(rw, http.StatusNotAcceptable, codeNotAcceptable,
+			fmt.Sprintf("%s value can not be sent as %s", typeName(v), octetStream))
+		return
+	}
+
+	rw.Header().Set("content-type", octetStream)
+	rw.WriteHeader(http.StatusOK)
+	if _, err := rw.Write(data); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+func (h *handler) get(rw http.ResponseWriter, r *http.Request) {
+	k, err := key(r)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("GET request for %s", k)
+	v, version, err := h.db.GetWithVersion(k)
+	if err != nil {
+		log.Printf("Failed to get %s: %s", k, err)
+		writeDbError(rw, err)
+		return
+	}
+
+	rw.Header().Set("etag", etag(version))
+	if ifNoneMatch := r.Header.Get("if-none-match"); ifNoneMatch != "" && matchETag(ifNoneMatch, version, true) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if acceptsRaw(r) {
+		writeRaw(rw, v)
+		return
+	}
+
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(valueResponse{Key: k, Type: typeName(v), Value: v}); err != nil {
+		log.Printf("Failed to write response %v: %s", v, err)
+	}
+}
+
+func (h *handler) head(rw http.ResponseWriter, r *http.Request) {
+	k, err := key(r)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, version, err := h.db.GetWithVersion(k); err == datastore.ErrNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+	} else if err != nil {
+		log.Printf("Failed to get %s: %s", k, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+	} else {
+		rw.Header().Set("content-type", "application/json")
+		rw.Header().Set("etag", etag(version))
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// put sets the value from {"value": ...} body, which is a JSON string or integer.
+// A body sent with Content-Type: application/octet-stream is stored as raw bytes.
+func (h *handler) put(rw http.ResponseWriter, r *http.Request) {
+	k, err := key(r)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("%s request for %s", r.Method, k)
+	if !h.checkWritable(rw) {
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading input: %s", err)
+		writeError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	var value interface{}
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("content-type")); t == octetStream {
+		log.Printf("Decoded %d bytes", len(bytes))
+		value = bytes
+	} else {
+		var body struct {
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(bytes, &body); err != nil {
+			log.Printf("Error decoding input: %s", err)
+			writeError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+		// A null value would be decoded as zero.
+		if body.Value == nil || string(body.Value) == "null" {
+			writeError(rw, http.StatusBadRequest, codeBadRequest, "value is missing")
+			return
+		}
+
+		var int64Value int64
+		var stringValue string
+		if err := json.Unmarshal(body.Value, &int64Value); err == nil {
+			log.Printf("Decoded int64: %d", int64Value)
+			value = int64Value
+		} else if err := json.Unmarshal(body.Value, &stringValue); err == nil {
+			log.Printf("Decoded string: %s", stringValue)
+			value = stringValue
+		} else {
+			writeError(rw, http.StatusBadRequest, codeBadRequest, "value must be a string or an integer")
+			return
+		}
+	}
+
+	version, conditional, err := h.precondition(r, k)
+	if err == nil && conditional {
+		err = h.db.PutIfVersion(k, value, version)
+	} else if err == nil {
+		err = h.putValue(k, value)
+	}
+	if err != nil {
+		log.Printf("Failed to set %s: %s", k, err)
+		writeDbError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) putValue(k string, value interface{}) error {
+	switch v := value.(type) {
+	case int64:
+		return h.db.PutInt64(k, v)
+	case []byte:
+		return h.db.PutBytes(k, v)
+	default:
+		return h.db.Put(k, value.(string))
+	}
+}
+
+func (h *handler) delete(rw http.ResponseWriter, r *http.Request) {
+	k, err := key(r)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("DELETE request for %s", k)
+	if !h.checkWritable(rw) {
+		return
+	}
+
+	version, conditional, err := h.precondition(r, k)
+	if err == nil && conditional {
+		err = h.db.DeleteIfVersion(k, version)
+	} else if err == nil {
+		err = h.db.Delete(k)
+	}
+	if err != nil {
+		log.Printf("Failed to delete %s: %s", k, err)
+		writeDbError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+type getManyRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// getManyResponse has values of found keys and the missing keys in the order
+// of the request.
+type getManyResponse struct {
+	Values  []valueResponse `json:"values"`
+	Missing []string        `json:"missing"`
+}
+
+func (h *handler) getMany(rw http.ResponseWriter, r *http.Request) {
+	body, err := readBody(rw, r, maxGetManyBody)
+	if err == errBodyTooLarge {
+		writeError(rw, http.StatusRequestEntityTooLarge, codeTooLarge, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("Error reading input: %s", err)
+		writeError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	var req getManyRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Printf("Error decoding input: %s", err)
+		writeError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if req.Keys == nil {
+		writeError(rw, http.StatusBadRequest, codeBadRequest, "keys are missing")
+		return
+	}
+
+	log.Printf("Multi-get request for %d keys", len(req.Keys))
+	values, err := h.db.GetMany(req.Keys)
+	if err != nil {
+		log.Printf("Failed to get %d keys: %s", len(req.Keys), err)
+		writeDbError(rw, err)
+		return
+	}
+
+	res := getManyResponse{
+		Values:  make([]valueResponse, 0, len(values)),
+		Missing: make([]string, 0, len(req.Keys)-len(values)),
+	}
+	for _, k := range req.Keys {
+		if v, ok := values[k]; ok {
+			res.Values = append(res.Values, valueResponse{Key: k, Type: typeName(v), Value: v})
+		} else {
+			res.Missing = append(res.Missing, k)
+		}
+	}
+
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+// watch streams changes of keys with the prefix as Server-Sent Events.
+func (h *handler) watch(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeError(rw, http.StatusInternalServerError, codeInternal, "streaming is not supported")
+		return
+	}
+
+	ctx, cancel := streamContext(r, h.shutdown)
+	defer cancel()
+
+	prefix := r.URL.Query().Get("prefix")
+	log.Printf("Watching keys with prefix %q", prefix)
+	w := h.db.Watch(prefix)
+	defer w.Close()
+
+	rw.Header().Set("content-type", "text/event-stream")
+	rw.Header().Set("cache-control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e, ok := <-w.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("Failed to encode event: %s", err)
+				return
+			}
+			_, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+			if err != nil {
+				log.Printf("Failed to write event: %s", err)
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *handler) export(rw http.ResponseWriter, _ *http.Request) {
+	log.Printf("Exporting database")
+	rw.Header().Set("content-type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	if err := h.db.Export(rw); err != nil {
+		log.Printf("Failed to export database: %s", err)
+	}
+}
+
+func (h *handler) importRecords(rw http.ResponseWriter, r *http.Request) {
+	log.Printf("Importing database")
+	if !h.checkWritable(rw) {
+		return
+	}
+
+	if err := h.db.Import(r.Body); err != nil {
+		log.Printf("Failed to import database: %s", err)
+		if errors.Is(err, datastore.ErrInvalidRecord) {
+			writeError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		} else {
+			writeError(rw, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
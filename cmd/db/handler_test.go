@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type handlerTestCase struct {
+	Name        string
+	Method      string
+	Path        string
+	ContentType string
+	Accept      string
+	IfMatch     string
+	IfNoneMatch string
+	Token       string
+	Body        string
+	Status      int
+	// Response is the expected JSON body, empty for no body check.
+	Response string
+	// RawResponse is the expected non-JSON body.
+	RawResponse string
+	Allow       string
+	ETag        string
+}
+
+func (c handlerTestCase) test(t *testing.T, h http.Handler) {
+	var body io.Reader
+	if c.Body != "" {
+		body = strings.NewReader(c.Body)
+	}
+	req := httptest.NewRequest(c.Method, c.Path, body)
+	if c.ContentType != "" {
+		req.Header.Set("content-type", c.ContentType)
+	}
+	if c.Accept != "" {
+		req.Header.Set("accept", c.Accept)
+	}
+	if c.IfMatch != "" {
+		req.Header.Set("if-match", c.IfMatch)
+	}
+	if c.IfNoneMatch != "" {
+		req.Header.Set("if-none-match", c.IfNoneMatch)
+	}
+	if c.Token != "" {
+		req.Header.Set("authorization", "Bearer "+c.Token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != c.Status {
+		t.Errorf("%s: unexpected status %d, expected %d (%s)", c.Name, rec.Code, c.Status, rec.Body)
+	}
+	if c.Response != "" {
+		var got, expected interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Errorf("%s: bad JSON response %s: %s", c.Name, rec.Body, err)
+		}
+		if err := json.Unmarshal([]byte(c.Response), &expected); err != nil {
+			t.Fatal(err)
+		}
+		gotJson, _ := json.Marshal(got)
+		expectedJson, _ := json.Marshal(expected)
+		if string(gotJson) != string(expectedJson) {
+			t.Errorf("%s: unexpected response %s, expected %s", c.Name, gotJson, expectedJson)
+		}
+	}
+	if c.RawResponse != "" && rec.Body.String() != c.RawResponse {
+		t.Errorf("%s: unexpected response %q, expected %q", c.Name, rec.Body, c.RawResponse)
+	}
+	if c.Allow != "" && rec.Header().Get("allow") != c.Allow {
+		t.Errorf("%s: unexpected Allow header %q", c.Name, rec.Header().Get("allow"))
+	}
+	if c.ETag != "" && rec.Header().Get("etag") != c.ETag {
+		t.Errorf("%s: unexpected ETag header %q, expected %q", c.Name, rec.Header().Get("etag"), c.ETag)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	db, dir := openTestDb(t)
+	defer os.RemoveAll(dir)
+	defer db.Close()
+
+	h := newHandler(db, false)
+	for _, c := range []handlerTestCase{
+		{
+			Name:     "get missing",
+			Method:   http.MethodGet,
+			Path:     "/db/missing",
+			Status:   http.StatusNotFound,
+			Response: `{"code":"not_found","message":"record does not exist"}`,
+		},
+		{
+			Name:   "put string",
+			Method: http.MethodPut,
+			Path:   "/db/key",
+			Body:   `{"value":"say \"hi\""}`,
+			Status: http.StatusOK,
+		},
+		{
+			Name:     "get string",
+			Method:   http.MethodGet,
+			Path:     "/db/key",
+			Status:   http.StatusOK,
+			Response: `{"key":"key","type":"string","value":"say \"hi\""}`,
+		},
+		{
+			Name:   "post int",
+			Method: http.MethodPost,
+			Path:   "/db/num",
+			Body:   `{"value":-12}`,
+			Status: http.StatusOK,
+		},
+		{
+			Name:     "get int",
+			Method:   http.MethodGet,
+			Path:     "/db/num",
+			Status:   http.StatusOK,
+			Response: `{"key":"num","type":"int64","value":-12}`,
+		},
+		{
+			Name:        "put bytes",
+			Method:      http.MethodPut,
+			Path:        "/db/bin",
+			ContentType: "application/octet-stream",
+			Body:        "\x00\xff{raw}",
+			Status:      http.StatusOK,
+		},
+		{
+			Name:        "get raw bytes",
+			Method:      http.MethodGet,
+			Path:        "/db/bin",
+			Accept:      "text/plain;q=0.5, application/octet-stream",
+			Status:      http.StatusOK,
+			RawResponse: "\x00\xff{raw}",
+		},
+		{
+			Name:     "get bytes as json",
+			Method:   http.MethodGet,
+			Path:     "/db/bin",
+			Status:   http.StatusOK,
+			Response: `{"key":"bin","type":"bytes","value":"AP97cmF3fQ=="}`,
+		},
+		{
+			Name:        "get raw string",
+			Method:      http.MethodGet,
+			Path:        "/db/key",
+			Accept:      "application/octet-stream",
+			Status:      http.StatusOK,
+			RawResponse: `say "hi"`,
+		},
+		{
+			Name:     "get raw int",
+			Method:   http.MethodGet,
+			Path:     "/db/num",
+			Accept:   "application/octet-stream",
+			Status:   http.StatusNotAcceptable,
+			Response: `{"code":"not_acceptable","message":"int64 value can not be sent as application/octet-stream"}`,
+		},
+		{
+			Name:     "get many",
+			Method:   http.MethodPost,
+			Path:     "/db/_mget",
+			Body:     `{"keys":["num","missing","key","bin"]}`,
+			Status:   http.StatusOK,
+			Response: `{"values":[{"key":"num","type":"int64","value":-12},{"key":"key","type":"string","value":"say \"hi\""},{"key":"bin","type":"bytes","value":"AP97cmF3fQ=="}],"missing":["missing"]}`,
+		},
+		{
+			Name:     "get many without keys",
+			Method:   http.MethodPost,
+			Path:     "/db/_mget",
+			Body:     `{}`,
+			Status:   http.StatusBadRequest,
+			Response: `{"code":"bad_request","message":"keys are missing"}`,
+		},
+		{
+			Name:     "get many too large",
+			Method:   http.MethodPost,
+			Path:     "/db/_mget",
+			Body:     `{"keys":["` + strings.Repeat("k", maxGetManyBody) + `"]}`,
+			Status:   http.StatusRequestEntityTooLarge,
+			Response: `{"code":"request_too_large","message":"request body is too large"}`,
+		},
+		{
+			Name:   "get many method",
+			Method: http.MethodGet,
+			Path:   "/db/_mget",
+			Status: http.StatusMethodNotAllowed,
+			Allow:  "POST",
+		},
+		{
+			Name:   "put encoded key",
+			Method: http.MethodPut,
+			Path:   "/db/a%2Fb%20c",
+			Body:   `{"value":"encoded"}`,
+			Status: http.StatusOK,
+		},
+		{
+			Name:     "get encoded key",
+			Method:   http.MethodGet,
+			Path:     "/db/a%2Fb%20c",
+			Status:   http.StatusOK,
+			Response: `{"key":"a/b c","type":"string","value":"encoded"}`,
+		},
+		{
+			Name:   "get etag",
+			Method: http.MethodGet,
+			Path:   "/db/num",
+			Status: http.StatusOK,
+			ETag:   `"2"`,
+		},
+		{
+			Name:        "get not modified",
+			Method:      http.MethodGet,
+			Path:        "/db/num",
+			IfNoneMatch: `"2"`,
+			Status:      http.StatusNotModified,
+		},
+		{
+			Name:     "put stale version",
+			Method:   http.MethodPut,
+			Path:     "/db/num",
+			IfMatch:  `"1"`,
+			Body:     `{"value":1}`,
+			Status:   http.StatusPreconditionFailed,
+			Response: `{"code":"precondition_failed","message":"record version does not match"}`,
+		},
+		{
+			Name:    "put matching version",
+			Method:  http.MethodPut,
+			Path:    "/db/num",
+			IfMatch: `"1", "2"`,
+			Body:    `{"value":-12}`,
+			Status:  http.StatusOK,
+		},
+		{
+			Name:        "create existing",
+			Method:      http.MethodPut,
+			Path:        "/db/num",
+			IfNoneMatch: "*",
+			Body:        `{"value":1}`,
+			Status:      http.StatusPreconditionFailed,
+		},
+		{
+			Name:        "create new",
+			Method:      http.MethodPut,
+			Path:        "/db/created",
+			IfNoneMatch: "*",
+			Body:        `{"value":1}`,
+			Status:      http.StatusOK,
+		},
+		{
+			Name:    "update missing",
+			Method:  http.MethodPut,
+			Path:    "/db/missing",
+			IfMatch: "*",
+			Body:    `{"value":1}`,
+			Status:  http.StatusPreconditionFailed,
+		},
+		{
+			Name:    "delete stale version",
+			Method:  http.MethodDelete,
+			Path:    "/db/num",
+			IfMatch: `"2"`,
+			Status:  http.StatusPreconditionFailed,
+		},
+		{
+			Name:   "head etag",
+			Method: http.MethodHead,
+			Path:   "/db/num",
+			Status: http.StatusOK,
+			ETag:   `"5"`,
+		},
+		{
+			Name:    "delete matching version",
+			Method:  http.MethodDelete,
+			Path:    "/db/created",
+			IfMatch: `"6"`,
+			Status:  http.StatusOK,
+		},
+		{
+			Name:     "missing value",
+			Method:   http.MethodPost,
+			Path:     "/db/key",
+			Body:     `{"other":1}`,
+			Status:   http.StatusBadRequest,
+			Response: `{"code":"bad_request","message":"value is missing"}`,
+		},
+		{
+			Name:     "null value",
+			Method:   http.MethodPost,
+			Path:     "/db/null",
+			Body:     `{"value":null}`,
+			Status:   http.StatusBadRequest,
+			Response: `{"code":"bad_request","message":"value is missing"}`,
+		},
+		{
+			Name:   "null value is not stored",
+			Method: http.MethodHead,
+			Path:   "/db/null",
+			Status: http.StatusNotFound,
+		},
+		{
+			Name:   "invalid json",
+			Method: http.MethodPut,
+			Path:   "/db/key",
+			Body:   `{"value":`,
+			Status: http.StatusBadRequest,
+		},
+		{
+			Name:     "unsupported value",
+			Method:   http.MethodPut,
+			Path:     "/db/key",
+			Body:     `{"value":[1]}`,
+			Status:   http.StatusBadRequest,
+			Response: `{"code":"bad_request","message":"value must be a string or an integer"}`,
+		},
+		{
+			Name:   "head existing",
+			Method: http.MethodHead,
+			Path:   "/db/key",
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "delete",
+			Method: http.MethodDelete,
+			Path:   "/db/key",
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "head deleted",
+			Method: http.MethodHead,
+			Path:   "/db/key",
+			Status: http.StatusNotFound,
+		},
+		{
+			Name:     "delete missing",
+			Method:   http.MethodDelete,
+			Path:     "/db/key",
+			Status:   http.StatusNotFound,
+			Response: `{"code":"not_found","message":"record does not exist"}`,
+		},
+		{
+			Name:     "method not allowed",
+			Method:   http.MethodPatch,
+			Path:     "/db/key",
+			Status:   http.StatusMethodNotAllowed,
+			Response: `{"code":"method_not_allowed","message":"method PATCH is not allowed"}`,
+			Allow:    "DELETE, GET, HEAD, POST, PUT",
+		},
+		{
+			Name:   "empty key",
+			Method: http.MethodGet,
+			Path:   "/db/",
+			Status: http.StatusBadRequest,
+		},
+		{
+			Name:   "import method",
+			Method: http.MethodGet,
+			Path:   "/admin/import",
+			Status: http.StatusMethodNotAllowed,
+			Allow:  "POST",
+		},
+		{
+			Name:   "invalid import",
+			Method: http.MethodPost,
+			Path:   "/admin/import",
+			Body:   `{"key":"a","type":"float","value":1.5}`,
+			Status: http.StatusBadRequest,
+		},
+	} {
+		c.test(t, h)
+	}
+
+	t.Run("read-only", func(t *testing.T) {
+		replica := newHandler(db, true)
+		for _, c := range []handlerTestCase{
+			{
+				Name:     "put",
+				Method:   http.MethodPut,
+				Path:     "/db/key",
+				Body:     `{"value":"v"}`,
+				Status:   http.StatusForbidden,
+				Response: `{"code":"read_only","message":"replica is read-only"}`,
+			},
+			{
+				Name:   "delete",
+				Method: http.MethodDelete,
+				Path:   "/db/num",
+				Status: http.StatusForbidden,
+			},
+			{
+				Name:     "get",
+				Method:   http.MethodGet,
+				Path:     "/db/num",
+				Status:   http.StatusOK,
+				Response: `{"key":"num","type":"int64","value":-12}`,
+			},
+		} {
+			c.test(t, replica)
+		}
+	})
+}
+
+func TestHandler_StopStreams(t *testing.T) {
+	db, dir := openTestDb(t)
+	defer os.RemoveAll(dir)
+	defer db.Close()
+
+	h := newHandler(db, false)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/db/watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	finished := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		finished <- err
+	}()
+
+	h.stopStreams()
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Errorf("Stream was not finished cleanly: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Stream was not finished on shutdown")
+	}
+}
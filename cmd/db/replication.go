@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/cmd/db/datastore"
+)
+
+const replicationPath = "/replication/stream"
+
+// replicationRecord is a change sent from the primary to replicas, one JSON object per line.
+type replicationRecord struct {
+	Seq   uint64          `json:"seq"`
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func encodeChange(e datastore.Event) (replicationRecord, error) {
+	rec := replicationRecord{
+		Seq: e.Seq,
+		Key: e.Key,
+	}
+
+	switch v := e.Value.(type) {
+	case nil:
+		rec.Type = "delete"
+		return rec, nil
+	case string:
+		rec.Type = "string"
+	case int64:
+		rec.Type = "int64"
+	case []byte:
+		rec.Type = "bytes"
+	default:
+		return rec, fmt.Errorf("unsupported value %v", v)
+	}
+
+	raw, err := json.Marshal(e.Value)
+	if err != nil {
+		return rec, err
+	}
+	rec.Value = raw
+	return rec, nil
+}
+
+func decodeChange(rec replicationRecord) (datastore.Event, error) {
+	e := datastore.Event{
+		Type: datastore.EventPut,
+		Key:  rec.Key,
+		Seq:  rec.Seq,
+	}
+
+	switch rec.Type {
+	case "delete":
+		e.Type = datastore.EventDelete
+		return e, nil
+	case "string":
+		var v string
+		err := json.Unmarshal(rec.Value, &v)
+		e.Value = v
+		return e, err
+	case "int64":
+		var v int64
+		err := json.Unmarshal(rec.Value, &v)
+		e.Value = v
+		return e, err
+	case "bytes":
+		var v []byte
+		err := json.Unmarshal(rec.Value, &v)
+		e.Value = v
+		return e, err
+	default:
+		return e, fmt.Errorf("unknown change type %q", rec.Type)
+	}
+}
+
+// replicationHandler streams changes with sequence numbers greater than the
+// since query parameter to a replica until it disconnects or shutdown is done.
+func replicationHandler(db *datastore.Db, shutdown context.Context) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		ctx, cancel := streamContext(r, shutdown)
+		defer cancel()
+
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var since uint64
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+			since, err = strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				log.Printf("Bad replication sequence number %s: %s", s, err)
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		log.Printf("Replica %s follows changes since %d", r.RemoteAddr, since)
+		rw.Header().Set("content-type", "application/x-ndjson")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		encoder := json.NewEncoder(rw)
+		err := db.Changes(ctx, since, func(e datastore.Event) error {
+			rec, err := encodeChange(e)
+			if err != nil {
+				return err
+			}
+			if err := encoder.Encode(rec); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		})
+		log.Printf("Replica %s stopped following: %s", r.RemoteAddr, err)
+	}
+}
+
+// replica applies changes streamed by the primary to the local database.
+// It reconnects after failures and continues from the last applied change.
+type replica struct {
+	db      *datastore.Db
+	primary string
+	client  *http.Client
+	retry   time.Duration
+	// token is the bearer token sent to the primary, if any.
+	token string
+}
+
+func (rp *replica) run(ctx context.Context) {
+	for {
+		err := rp.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Replication from %s failed: %s", rp.primary, err)
+
+		select {
+		case <-time.After(rp.retry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (rp *replica) follow(ctx context.Context) error {
+	since := rp.db.LastSeq()
+	url := fmt.Sprintf("%s%s?since=%d", rp.primary, replicationPath, since)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if rp.token != "" {
+		req.Header.Set("authorization", "Bearer "+rp.token)
+	}
+
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary responded with %s", resp.Status)
+	}
+
+	log.Printf("Replicating from %s since %d", rp.primary, since)
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var rec replicationRecord
+		if err := decoder.Decode(&rec); err != nil {
+			return err
+		}
+
+		e, err := decodeChange(rec)
+		if err != nil {
+			return err
+		}
+		if err := rp.db.Apply(e); err != nil {
+			return err
+		}
+	}
+}
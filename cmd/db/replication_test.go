@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/cmd/db/datastore"
+)
+
+func openTestDb(t *testing.T) (*datastore.Db, string) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDb(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, dir
+}
+
+func startReplica(db *datastore.Db, primaryUrl string) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	rp := &replica{
+		db:      db,
+		primary: primaryUrl,
+		client:  new(http.Client),
+		retry:   10 * time.Millisecond,
+	}
+	done := make(chan struct{})
+	go func() {
+		rp.run(ctx)
+		close(done)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func waitForSeq(t *testing.T, db *datastore.Db, seq uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for db.LastSeq() < seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("Replica did not catch up: seq %d, expected %d", db.LastSeq(), seq)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primaryDb, primaryDir := openTestDb(t)
+	defer os.RemoveAll(primaryDir)
+	defer primaryDb.Close()
+
+	h := new(http.ServeMux)
+	h.HandleFunc(replicationPath, replicationHandler(primaryDb, context.Background()))
+	primary := httptest.NewServer(h)
+	defer primary.Close()
+
+	if err := primaryDb.Put("before", "replica started"); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		replicas []*datastore.Db
+		dirs     []string
+		stops    []context.CancelFunc
+	)
+	for i := 0; i < 2; i++ {
+		db, dir := openTestDb(t)
+		defer os.RemoveAll(dir)
+		replicas = append(replicas, db)
+		dirs = append(dirs, dir)
+		stops = append(stops, startReplica(db, primary.URL))
+	}
+
+	if err := primaryDb.PutInt64("counter", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := primaryDb.Put("quote", `"quoted"`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, db := range replicas {
+		waitForSeq(t, db, primaryDb.LastSeq())
+		if v, err := db.Get("before"); err != nil || v != "replica started" {
+			t.Errorf("Bad replicated value: %s, %v", v, err)
+		}
+		if v, err := db.GetInt64("counter"); err != nil || v != 42 {
+			t.Errorf("Bad replicated value: %d, %v", v, err)
+		}
+		if v, err := db.Get("quote"); err != nil || v != `"quoted"` {
+			t.Errorf("Bad replicated value: %s, %v", v, err)
+		}
+	}
+
+	t.Run("catch up after restart", func(t *testing.T) {
+		stops[0]()
+		if err := replicas[0].Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := primaryDb.Delete("before"); err != nil {
+			t.Fatal(err)
+		}
+		if err := primaryDb.PutInt64("counter", 43); err != nil {
+			t.Fatal(err)
+		}
+
+		waitForSeq(t, replicas[1], primaryDb.LastSeq())
+		if replicas[0].LastSeq() == primaryDb.LastSeq() {
+			t.Fatal("Stopped replica must not receive changes")
+		}
+
+		db, err := datastore.NewDb(dirs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas[0] = db
+		stops[0] = startReplica(db, primary.URL)
+		waitForSeq(t, replicas[0], primaryDb.LastSeq())
+
+		for _, db := range replicas {
+			if _, err := db.Get("before"); err != datastore.ErrNotFound {
+				t.Errorf("Delete was not replicated: %v", err)
+			}
+			if v, err := db.GetInt64("counter"); err != nil || v != 43 {
+				t.Errorf("Bad replicated value: %d, %v", v, err)
+			}
+		}
+	})
+
+	for i, stop := range stops {
+		stop()
+		replicas[i].Close()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/httptools"
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/signal"
+)
+
+var (
+	port   = flag.Int("port", 8075, "router port")
+	nodes  = flag.String("nodes", "http://database:8070", "comma separated urls of db nodes")
+	vnodes = flag.Int("vnodes", 128, "number of virtual nodes per db node on the hash ring")
+	token  = flag.String("token", "", "bearer token used to move keys between db nodes and required to manage nodes via /admin/nodes")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "time to wait for in-flight requests on shutdown")
+)
+
+func main() {
+	flag.Parse()
+
+	var urls []string
+	for _, node := range strings.Split(*nodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			urls = append(urls, node)
+		}
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	rt, err := newRouter(*vnodes, client, urls...)
+	if err != nil {
+		log.Fatalf("Failed to create router: %s", err)
+	}
+	rt.token = *token
+
+	h := new(http.ServeMux)
+	h.Handle("/db/", rt)
+	h.HandleFunc("/db/_mget", rt.getMany)
+	h.HandleFunc("/admin/nodes", rt.serveNodes)
+
+	server := httptools.CreateServer(*port, h)
+	log.Printf("Routing keys across %s", strings.Join(urls, ", "))
+	server.Start()
+	<-signal.TerminationContext().Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down the server: %s", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// ring is a consistent hash ring. Every node is placed on the ring
+// vnodes times, and a key belongs to the first node clockwise from its hash.
+type ring struct {
+	vnodes int
+	hashes []uint32
+	owners map[uint32]string
+	nodes  []string
+}
+
+func newRing(vnodes int, nodes ...string) *ring {
+	r := &ring{
+		vnodes: vnodes,
+		owners: make(map[uint32]string),
+	}
+	for _, node := range nodes {
+		r = r.with(node)
+	}
+	return r
+}
+
+// with returns a copy of the ring with the node added.
+func (r *ring) with(node string) *ring {
+	res := &ring{
+		vnodes: r.vnodes,
+		hashes: make([]uint32, len(r.hashes), len(r.hashes)+r.vnodes),
+		owners: make(map[uint32]string, len(r.owners)+r.vnodes),
+		nodes:  append(append([]string(nil), r.nodes...), node),
+	}
+	copy(res.hashes, r.hashes)
+	for h, n := range r.owners {
+		res.owners[h] = n
+	}
+
+	for i := 0; i < r.vnodes; i++ {
+		h := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+		if _, ok := res.owners[h]; ok {
+			continue
+		}
+		res.owners[h] = node
+		res.hashes = append(res.hashes, h)
+	}
+	sort.Slice(res.hashes, func(i, j int) bool {
+		return res.hashes[i] < res.hashes[j]
+	})
+	return res
+}
+
+func (r *ring) has(node string) bool {
+	for _, n := range r.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// node returns the node owning the key, or empty string if the ring is empty.
+func (r *ring) node(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	if n := newRing(16).node("key"); n != "" {
+		t.Errorf("Empty ring returned node %s", n)
+	}
+
+	r := newRing(128, "node1", "node2", "node3")
+	const keys = 10000
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		counts[r.node("key"+strconv.Itoa(i))]++
+	}
+	for _, node := range []string{"node1", "node2", "node3"} {
+		if counts[node] < keys/6 {
+			t.Errorf("Node %s got too few keys: %d", node, counts[node])
+		}
+	}
+
+	bigger := r.with("node4")
+	if r.has("node4") || !bigger.has("node4") {
+		t.Error("Adding a node must not change the original ring")
+	}
+
+	moved := 0
+	for i := 0; i < keys; i++ {
+		k := "key" + strconv.Itoa(i)
+		before, after := r.node(k), bigger.node(k)
+		if before != after {
+			moved++
+			if after != "node4" {
+				t.Fatalf("Key %s moved between old nodes %s -> %s", k, before, after)
+			}
+		}
+	}
+	if moved < keys/8 || moved > keys/3 {
+		t.Errorf("Unexpected number of moved keys: %d of %d", moved, keys)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// router proxies /db/<key> requests to the db node owning the key.
+type router struct {
+	sync.RWMutex
+	ring    *ring
+	proxies map[string]*httputil.ReverseProxy
+	client  *http.Client
+	// token is the bearer token used to move keys between nodes. Clients
+	// managing nodes must have it as well.
+	token string
+}
+
+func newRouter(vnodes int, client *http.Client, nodes ...string) (*router, error) {
+	rt := &router{
+		ring:    newRing(vnodes),
+		proxies: make(map[string]*httputil.ReverseProxy),
+		client:  client,
+	}
+	for _, node := range nodes {
+		if err := rt.addProxy(node); err != nil {
+			return nil, err
+		}
+		rt.ring = rt.ring.with(node)
+	}
+	return rt, nil
+}
+
+func (rt *router) addProxy(node string) error {
+	u, err := url.Parse(node)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid node url %s", node)
+	}
+	rt.proxies[node] = httputil.NewSingleHostReverseProxy(u)
+	return nil
+}
+
+func (rt *router) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	k, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/db/"))
+	if err != nil || k == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Watching a prefix needs changes of every node.
+	if k == "watch" {
+		rw.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	// Requests wait while keys are migrated to a new node. Writes keep the
+	// lock until they are done, so that the migration does not miss them, but
+	// reads release it right away not to block adding nodes for long.
+	rt.RLock()
+	node := rt.ring.node(k)
+	proxy := rt.proxies[node]
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		rt.RUnlock()
+	} else {
+		defer rt.RUnlock()
+	}
+
+	if node == "" {
+		log.Printf("No nodes to serve %s", k)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	proxy.ServeHTTP(rw, r)
+}
+
+// getMany serves POST /db/_mget by sending the keys to the nodes owning them
+// and merging the responses.
+func (rt *router) getMany(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Keys == nil {
+		log.Printf("Error decoding input: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rt.RLock()
+	defer rt.RUnlock()
+
+	byNode := make(map[string][]string)
+	for _, k := range req.Keys {
+		node := rt.ring.node(k)
+		if node == "" {
+			log.Printf("No nodes to serve %s", k)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		byNode[node] = append(byNode[node], k)
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		values = make(map[string]json.RawMessage)
+		failed error
+	)
+	for node, keys := range byNode {
+		wg.Add(1)
+		go func(node string, keys []string) {
+			defer wg.Done()
+			found, err := rt.getManyFrom(r, node, keys)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = fmt.Errorf("%s: %w", node, err)
+				return
+			}
+			for k, v := range found {
+				values[k] = v
+			}
+		}(node, keys)
+	}
+	wg.Wait()
+
+	if failed != nil {
+		log.Printf("Failed to get keys: %s", failed)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	res := struct {
+		Values  []json.RawMessage `json:"values"`
+		Missing []string          `json:"missing"`
+	}{
+		Values:  make([]json.RawMessage, 0, len(values)),
+		Missing: make([]string, 0),
+	}
+	for _, k := range req.Keys {
+		if v, ok := values[k]; ok {
+			res.Values = append(res.Values, v)
+		} else {
+			res.Missing = append(res.Missing, k)
+		}
+	}
+
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+// getManyFrom returns values of the keys found on the node by their keys.
+func (rt *router) getManyFrom(r *http.Request, node string, keys []string) (map[string]json.RawMessage, error) {
+	body, err := json.Marshal(struct {
+		Keys []string `json:"keys"`
+	}{keys})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, node+"/db/_mget", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	// Nodes check permissions of the client.
+	if auth := r.Header.Get("authorization"); auth != "" {
+		req.Header.Set("authorization", auth)
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("multi-get responded with %s", resp.Status)
+	}
+
+	var res struct {
+		Values []json.RawMessage `json:"values"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]json.RawMessage, len(res.Values))
+	for _, v := range res.Values {
+		var value struct {
+			Key string `json:"key"`
+		}
+		if err := json.Unmarshal(v, &value); err != nil {
+			return nil, err
+		}
+		found[value.Key] = v
+	}
+	return found, nil
+}
+
+func (rt *router) nodes() []string {
+	rt.RLock()
+	defer rt.RUnlock()
+	return append([]string(nil), rt.ring.nodes...)
+}
+
+// addNode adds the node to the ring and moves the keys it now owns from the
+// other nodes. Requests are not served until the keys are copied, copies left
+// on the old nodes are deleted afterwards.
+func (rt *router) addNode(node string) error {
+	movedKeys, err := rt.migrate(node)
+	if err != nil {
+		return err
+	}
+
+	// Copies left on old nodes are never read again, so failures are only logged.
+	for old, keys := range movedKeys {
+		for _, k := range keys {
+			req, err := http.NewRequest(http.MethodDelete, old+"/db/"+url.PathEscape(k), nil)
+			if err != nil {
+				log.Printf("Failed to delete moved key %s from %s: %s", k, old, err)
+				continue
+			}
+			resp, err := rt.do(req)
+			if err != nil {
+				log.Printf("Failed to delete moved key %s from %s: %s", k, old, err)
+				continue
+			}
+			resp.Body.Close()
+		}
+		log.Printf("Moved %d keys from %s to %s", len(keys), old, node)
+	}
+
+	return nil
+}
+
+// migrate adds the node to the ring after copying the keys it now owns to it.
+// It returns the moved keys by the nodes they were copied from.
+func (rt *router) migrate(node string) (map[string][]string, error) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	if rt.ring.has(node) {
+		return nil, fmt.Errorf("node %s already exists", node)
+	}
+	if err := rt.addProxy(node); err != nil {
+		return nil, err
+	}
+	newRing := rt.ring.with(node)
+
+	var moved bytes.Buffer
+	movedKeys := make(map[string][]string)
+	for _, old := range rt.ring.nodes {
+		err := rt.export(old, func(key string, line []byte) {
+			// Copies of keys moved before may be left if deleting them failed.
+			if rt.ring.node(key) == old && newRing.node(key) == node {
+				moved.Write(line)
+				moved.WriteByte('\n')
+				movedKeys[old] = append(movedKeys[old], key)
+			}
+		})
+		if err != nil {
+			delete(rt.proxies, node)
+			return nil, fmt.Errorf("cannot export keys from %s: %w", old, err)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, node+"/admin/import", &moved)
+	var resp *http.Response
+	if err == nil {
+		req.Header.Set("content-type", "application/x-ndjson")
+		resp, err = rt.do(req)
+	}
+	if err != nil {
+		delete(rt.proxies, node)
+		return nil, fmt.Errorf("cannot import keys to %s: %w", node, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		delete(rt.proxies, node)
+		return nil, fmt.Errorf("cannot import keys to %s: %s", node, resp.Status)
+	}
+
+	rt.ring = newRing
+	return movedKeys, nil
+}
+
+// export calls fn with every exported record of the node.
+func (rt *router) export(node string, fn func(key string, line []byte)) error {
+	req, err := http.NewRequest(http.MethodGet, node+"/admin/export", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rt.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("export responded with %s", resp.Status)
+	}
+
+	in := bufio.NewScanner(resp.Body)
+	in.Buffer(nil, 64<<20)
+	for in.Scan() {
+		var rec struct {
+			Key string `json:"key"`
+		}
+		if err := json.Unmarshal(in.Bytes(), &rec); err != nil {
+			return err
+		}
+		fn(rec.Key, in.Bytes())
+	}
+	return in.Err()
+}
+
+// do sends the router's own request to a node.
+func (rt *router) do(req *http.Request) (*http.Response, error) {
+	if rt.token != "" {
+		req.Header.Set("authorization", "Bearer "+rt.token)
+	}
+	return rt.client.Do(req)
+}
+
+// authorized reports whether the request has the router's bearer token.
+// Nothing is authorized if the router has no token.
+func (rt *router) authorized(r *http.Request) bool {
+	header := r.Header.Get("authorization")
+	const scheme = "bearer "
+	if rt.token == "" || len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return false
+	}
+	token := strings.TrimSpace(header[len(scheme):])
+	return subtle.ConstantTimeCompare([]byte(rt.token), []byte(token)) == 1
+}
+
+// serveNodes lists nodes on GET and adds a node on POST with {"url": "..."} body.
+// Both require the router's bearer token.
+func (rt *router) serveNodes(rw http.ResponseWriter, r *http.Request) {
+	if !rt.authorized(r) {
+		rw.Header().Set("www-authenticate", `Bearer realm="dbrouter"`)
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		if err := json.NewEncoder(rw).Encode(rt.nodes()); err != nil {
+			log.Printf("Failed to write response: %s", err)
+		}
+	case http.MethodPost:
+		var body struct {
+			Url string `json:"url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Url == "" {
+			log.Printf("Error decoding input: %v", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("Adding node %s", body.Url)
+		if err := rt.addNode(body.Url); err != nil {
+			log.Printf("Failed to add node %s: %s", body.Url, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode implements the parts of the db server API used by the router.
+type fakeNode struct {
+	sync.Mutex
+	values map[string]string
+}
+
+func (n *fakeNode) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	n.Lock()
+	defer n.Unlock()
+
+	switch {
+	case r.URL.Path == "/admin/export":
+		for k, v := range n.values {
+			fmt.Fprintf(rw, "{\"key\":%q,\"type\":\"string\",\"value\":%q}\n", k, v)
+		}
+	case r.URL.Path == "/admin/import":
+		in := bufio.NewScanner(r.Body)
+		for in.Scan() {
+			var rec struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			}
+			if err := json.Unmarshal(in.Bytes(), &rec); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			n.values[rec.Key] = rec.Value
+		}
+	case r.URL.Path == "/db/_mget":
+		var req struct {
+			Keys []string `json:"keys"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var values []string
+		for _, k := range req.Keys {
+			if v, ok := n.values[k]; ok {
+				values = append(values, fmt.Sprintf("{\"key\":%q,\"type\":\"string\",\"value\":%q}", k, v))
+			}
+		}
+		fmt.Fprintf(rw, "{\"values\":[%s]}", strings.Join(values, ","))
+	case strings.HasPrefix(r.URL.Path, "/db/"):
+		k := strings.TrimPrefix(r.URL.Path, "/db/")
+		switch r.Method {
+		case http.MethodGet:
+			v, ok := n.values[k]
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(rw, v)
+		case http.MethodPost:
+			b, _ := ioutil.ReadAll(r.Body)
+			n.values[k] = string(b)
+		case http.MethodDelete:
+			delete(n.values, k)
+		}
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRouter_AddNode(t *testing.T) {
+	var (
+		fakes []*fakeNode
+		urls  []string
+	)
+	for i := 0; i < 3; i++ {
+		n := &fakeNode{values: make(map[string]string)}
+		s := httptest.NewServer(n)
+		defer s.Close()
+		fakes = append(fakes, n)
+		urls = append(urls, s.URL)
+	}
+
+	rt, err := newRouter(64, new(http.Client), urls[:2]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(rt)
+	defer front.Close()
+
+	const keys = 200
+	for i := 0; i < keys; i++ {
+		k := "key" + strconv.Itoa(i)
+		resp, err := http.Post(front.URL+"/db/"+k, "text/plain", strings.NewReader("value"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(fakes[0].values) == 0 || len(fakes[1].values) == 0 {
+		t.Fatalf("Keys are not spread across nodes: %d, %d", len(fakes[0].values), len(fakes[1].values))
+	}
+
+	if err := rt.addNode(urls[2]); err != nil {
+		t.Fatalf("Cannot add node: %s", err)
+	}
+	if err := rt.addNode(urls[2]); err == nil {
+		t.Error("Adding the same node twice must fail")
+	}
+
+	total := 0
+	for _, n := range fakes {
+		total += len(n.values)
+	}
+	if total != keys {
+		t.Errorf("Moved keys were not removed from old nodes: %d keys stored", total)
+	}
+	if len(fakes[2].values) == 0 {
+		t.Error("No keys were moved to the new node")
+	}
+
+	for i := 0; i < keys; i++ {
+		k := "key" + strconv.Itoa(i)
+		resp, err := http.Get(front.URL + "/db/" + k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "value"+strconv.Itoa(i) {
+			t.Errorf("Bad response for %s: %d %s", k, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestRouter_GetMany(t *testing.T) {
+	var urls []string
+	for i := 0; i < 3; i++ {
+		n := &fakeNode{values: make(map[string]string)}
+		for j := 0; j < 30; j++ {
+			n.values["node"+strconv.Itoa(i)+"-"+strconv.Itoa(j)] = "value"
+		}
+		s := httptest.NewServer(n)
+		defer s.Close()
+		urls = append(urls, s.URL)
+	}
+
+	rt, err := newRouter(64, new(http.Client), urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Put every key to the node owning it.
+	for i := 0; i < 30; i++ {
+		k := "key" + strconv.Itoa(i)
+		rt.proxies[rt.ring.node(k)].ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodPost, "/db/"+k, strings.NewReader("value"+strconv.Itoa(i))))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/db/", rt)
+	mux.HandleFunc("/db/_mget", rt.getMany)
+	front := httptest.NewServer(mux)
+	defer front.Close()
+
+	keys := []string{"missing"}
+	for i := 29; i >= 0; i-- {
+		keys = append(keys, "key"+strconv.Itoa(i))
+	}
+	body, _ := json.Marshal(map[string][]string{"keys": keys})
+	resp, err := http.Post(front.URL+"/db/_mget", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d", resp.StatusCode)
+	}
+
+	var res struct {
+		Values []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"values"`
+		Missing []string `json:"missing"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Missing) != 1 || res.Missing[0] != "missing" {
+		t.Errorf("Unexpected missing keys %v", res.Missing)
+	}
+	if len(res.Values) != 30 {
+		t.Fatalf("Unexpected number of values %d", len(res.Values))
+	}
+	for i, v := range res.Values {
+		k := keys[i+1]
+		if v.Key != k || v.Value != "value"+strings.TrimPrefix(k, "key") {
+			t.Errorf("Unexpected value %+v for %s", v, k)
+		}
+	}
+}
+
+func TestRouter_Nodes(t *testing.T) {
+	var urls []string
+	for i := 0; i < 2; i++ {
+		s := httptest.NewServer(&fakeNode{values: make(map[string]string)})
+		defer s.Close()
+		urls = append(urls, s.URL)
+	}
+
+	rt, err := newRouter(64, new(http.Client), urls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.token = "secret"
+	front := httptest.NewServer(http.HandlerFunc(rt.serveNodes))
+	defer front.Close()
+
+	for _, c := range []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{"list without token", http.MethodGet, "", http.StatusUnauthorized},
+		{"add without token", http.MethodPost, "", http.StatusUnauthorized},
+		{"add with unknown token", http.MethodPost, "other", http.StatusUnauthorized},
+		{"add", http.MethodPost, "secret", http.StatusOK},
+		{"list", http.MethodGet, "secret", http.StatusOK},
+	} {
+		req, err := http.NewRequest(c.method, front.URL, strings.NewReader(fmt.Sprintf("{\"url\":%q}", urls[1])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.token != "" {
+			req.Header.Set("authorization", "Bearer "+c.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: unexpected status %d", c.name, resp.StatusCode)
+		}
+	}
+	if nodes := rt.nodes(); len(nodes) != 2 {
+		t.Errorf("Unexpected nodes %v", nodes)
+	}
+}
+
+func TestRouter_Watch(t *testing.T) {
+	s := httptest.NewServer(&fakeNode{values: make(map[string]string)})
+	defer s.Close()
+	rt, err := newRouter(64, new(http.Client), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	rt.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db/watch?prefix=key", nil))
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Unexpected status %d", rw.Code)
+	}
+}
+
+func TestRouter_AddNodeDuringRequest(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/db/") {
+			close(started)
+			<-finish
+		}
+	}))
+	defer slow.Close()
+	added := httptest.NewServer(&fakeNode{values: make(map[string]string)})
+	defer added.Close()
+
+	rt, err := newRouter(64, new(http.Client), slow.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(rt)
+	defer front.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(front.URL + "/db/key")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+
+	// The request in flight does not block adding the node.
+	if err := rt.addNode(added.URL); err != nil {
+		t.Fatalf("Cannot add node: %s", err)
+	}
+	close(finish)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRouter_AddNodeDuringWrite(t *testing.T) {
+	old := &fakeNode{values: make(map[string]string)}
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	oldServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			close(started)
+			<-finish
+		}
+		old.ServeHTTP(rw, r)
+	}))
+	defer oldServer.Close()
+	added := &fakeNode{values: make(map[string]string)}
+	addedServer := httptest.NewServer(added)
+	defer addedServer.Close()
+
+	rt, err := newRouter(64, new(http.Client), oldServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(rt)
+	defer front.Close()
+
+	// The key is moved to the added node.
+	newRing := rt.ring.with(addedServer.URL)
+	k := ""
+	for i := 0; k == ""; i++ {
+		if key := "key" + strconv.Itoa(i); newRing.node(key) == addedServer.URL {
+			k = key
+		}
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		resp, err := http.Post(front.URL+"/db/"+k, "text/plain", strings.NewReader("value"))
+		if err == nil {
+			resp.Body.Close()
+		}
+		written <- err
+	}()
+	<-started
+
+	// The migration waits for the write in flight.
+	nodeAdded := make(chan error, 1)
+	go func() {
+		nodeAdded <- rt.addNode(addedServer.URL)
+	}()
+	select {
+	case <-nodeAdded:
+		t.Fatal("Node was added while a write was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(finish)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-nodeAdded; err != nil {
+		t.Fatalf("Cannot add node: %s", err)
+	}
+	added.Lock()
+	defer added.Unlock()
+	if added.values[k] != "value" {
+		t.Errorf("Written key %s was not moved to the added node", k)
+	}
+}
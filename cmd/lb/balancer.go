@@ -1,51 +1,73 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"errors"
 	"flag"
-	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/OlegVanyaGreatBand/kpi-lab-2/httptools"
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/lbconfig"
 	"github.com/OlegVanyaGreatBand/kpi-lab-2/signal"
 )
 
 var (
 	port = flag.Int("port", 8090, "load balancer port")
-	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
+	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds, upgraded connections and event streams are limited only until response headers (0 disables the timeout)")
+	connectTimeout = flag.Duration("connect-timeout", time.Second, "timeout of connecting to a backend (0 disables the timeout)")
+	responseHeaderTimeout = flag.Duration("response-header-timeout", 0, "timeout of waiting for response headers from a backend (0 disables the timeout)")
+	routes routeTimeouts
 	https = flag.Bool("https", false, "whether backends support HTTPs")
+	configPath = flag.String("config", "", "backends config file, reloaded on SIGHUP or change; overrides -backends")
+	backends = flag.String("backends", "server1:8080,server2:8080,server3:8080", "comma separated backend addresses with optional weights, e.g. server1:8080=2")
+	healthPath = flag.String("health-path", lbconfig.DefaultHealthPath, "health check path of backends from -backends")
+	healthInterval = flag.Duration("health-interval", time.Duration(lbconfig.DefaultHealthCheck.Interval), "time between health checks of backends from -backends")
+	healthJitter = flag.Duration("health-jitter", 0, "maximum random delay added to the health check interval")
+	healthTimeout = flag.Duration("health-timeout", time.Duration(lbconfig.DefaultHealthCheck.Timeout), "health check timeout")
+	healthRise = flag.Int("health-rise", lbconfig.DefaultHealthCheck.Rise, "passed health checks in a row to mark a backend healthy")
+	healthFall = flag.Int("health-fall", lbconfig.DefaultHealthCheck.Fall, "failed health checks in a row to mark a backend unhealthy")
+	healthStatus = flag.Int("health-status", lbconfig.DefaultHealthCheck.ExpectStatus, "status code of a healthy backend")
+	healthBody = flag.String("health-body", "", "text the health check response of a healthy backend must contain")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	vnodes = flag.Int("vnodes", 100, "number of virtual nodes per server on the ip-hash ring")
+	trustedProxies = flag.String("trusted-proxies", "", "comma separated CIDRs of proxies whose Forwarded and X-Forwarded-For headers are trusted")
+	strategyName = flag.String("strategy", "ip-hash", "balancing strategy: ip-hash, round-robin, least-connections, weighted-round-robin, power-of-two or least-latency")
+
+	tlsCert = flag.String("tls-cert", "", "certificate file to serve HTTPS with")
+	tlsKey = flag.String("tls-key", "", "private key file of the HTTPS certificate")
+	tlsClientCA = flag.String("tls-client-ca", "", "CA file to verify client certificates with (mutual TLS)")
+	outlierFailures = flag.Int("outlier-failures", 5, "errors or 5xx responses of a backend in a row to eject it from balancing (0 disables ejection)")
+	outlierEjection = flag.Duration("outlier-ejection", 30*time.Second, "time of the first ejection of a backend, doubled on every next one")
+	outlierMaxEjection = flag.Duration("outlier-max-ejection", 5*time.Minute, "maximum ejection time of a backend")
+	retries = flag.Int("retries", 2, "maximum number of retries of a request that got no response on other backends")
+	retryBudgetRatio = flag.Float64("retry-budget", 0.2, "ratio of requests in flight that can be retried at the same time")
+	retryBudgetMin = flag.Int("retry-budget-min", 3, "number of retries in flight allowed regardless of the retry budget")
+	retryBodyLimit = flag.Int64("retry-body-limit", 64<<10, "maximum size of request bodies kept in memory to be retried")
+	idleConnsPerHost = flag.Int("idle-conns-per-host", 32, "maximum number of idle connections kept to every backend")
+	tryTimeout = flag.Duration("try-timeout", 0, "timeout of every try of a request (0 means only the request timeout applies)")
+	statsPath = flag.String("stats-path", "/lb/stats", "path serving the state of backends instead of forwarding (empty disables)")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "time to wait for in-flight requests on shutdown")
 )
 
 type Server struct {
 	name string
 	isHealthy bool
+	// weight is used by the weighted round-robin, zero means 1.
+	weight int
+	health lbconfig.HealthCheck
 }
 
-var (
-	timeout = time.Duration(*timeoutSec) * time.Second
-	serversPool = []Server{
-		{
-			name: "server1:8080",
-			isHealthy: true,
-		},
-		{
-			name: "server2:8080",
-			isHealthy: true,
-		},
-		{
-			name: "server3:8080",
-			isHealthy: true,
-		},
+func (s Server) effectiveWeight() int {
+	if s.weight <= 0 {
+		return 1
 	}
-)
+	return s.weight
+}
 
 func scheme() string {
 	if *https {
@@ -54,129 +76,200 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
+// balancer forwards requests to servers of the pool chosen by the strategy.
+// Requests that did not get a response are retried on other servers if their
+// body can be sent again and they are idempotent or were not sent at all.
+type balancer struct {
+	pool     *Pool
+	strategy Strategy
+	clients  *clientIdentity
+	outliers *outliers
+	proxy    *proxy
+
+	timeouts timeouts
+	// routes override timeouts for path prefixes.
+	routes routeTimeouts
+	// tryTimeout limits every try if set.
+	tryTimeout time.Duration
+	// retries is the maximum number of retries of a request.
+	retries int
+	budget  *retryBudget
+	// bodyLimit is the maximum size of bodies kept in memory to be sent again.
+	bodyLimit int64
+}
+
+func (b *balancer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	ip, err := b.clients.ip(r)
 	if err != nil {
-		return false
+		log.Printf("Failed to get client address: %s", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		return false
+	sum := hashIP(ip)
+	if *traceEnabled {
+		log.Printf("Client's IP: %s, hashsum: %d", ip, sum)
 	}
-	return true
-}
 
-func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
-	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst
-
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
-			}
-		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
-		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
-		if err != nil {
-			log.Printf("Failed to write response: %s", err)
-		}
-		return nil
-	} else {
-		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		return err
+	body, replayable, err := replayableBody(r, b.bodyLimit)
+	if err != nil {
+		log.Printf("Failed to read request body: %s", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
 	}
-}
-
-func hash(ip string) (uint32, error) {
-	host := ip
-
-	if pos := strings.IndexByte(ip, ':'); pos != -1 {
-		host = ip[:pos]
+	defer b.budget.request()()
+	t := b.routes.forPath(b.timeouts, r.URL.Path)
+	ctx := r.Context()
+	if t.total > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = withTotalTimeout(ctx, t.total)
+		defer cancel()
 	}
 
-	var sum uint32 = 0
-	octets := strings.Split(host, ".")
-	if len(octets) < 4 {
-		return 0, errors.New(fmt.Sprintf("invalid ip %s", ip))
-	}
-	for i, octet := range octets {
-		n, e := strconv.Atoi(octet)
-		if e != nil {
-			return 0, e
+	pool := b.outliers.filter(b.pool.Servers())
+	for try := 0; ; try++ {
+		server, err := b.strategy.Choose(sum, pool)
+		if err != nil {
+			log.Printf("return 503, no servers avaliable")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
 		}
 
-		if n > 255 {
-			return 0, errors.New(fmt.Sprintf("invalid ip %s", ip))
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		err = b.forwardTo(ctx, server, rw, r, t)
+		if err == nil {
+			return
 		}
 
-		sum += uint32(n) << (i * 8)
+		if !replayable || !retryable(r, err) || try >= b.retries || ctx.Err() != nil {
+			break
+		}
+		done, ok := b.budget.retry()
+		if !ok {
+			log.Printf("Retry budget is exhausted")
+			break
+		}
+		defer done()
+		// Other servers are tried next.
+		pool = without(pool, server)
 	}
-
-	return sum, nil
+	rw.WriteHeader(http.StatusServiceUnavailable)
 }
 
-func balance(sum uint32, pool []Server) (string, error) {
-	var healthyServers []string
+// forwardTo forwards a try of the request to the server and accounts its
+// result. The reverse proxy panics with http.ErrAbortHandler if the response
+// is cut short, the try is accounted as failed then.
+func (b *balancer) forwardTo(ctx context.Context, server string, rw http.ResponseWriter, r *http.Request, t timeouts) (err error) {
+	tryCtx := ctx
+	if b.tryTimeout > 0 {
+		var cancel context.CancelFunc
+		tryCtx, cancel = context.WithTimeout(ctx, b.tryTimeout)
+		defer cancel()
+	}
 
-	for _, server := range pool {
-		if server.isHealthy {
-			healthyServers = append(healthyServers, server.name)
+	start := time.Now()
+	status, aborted := 0, true
+	defer func() {
+		b.strategy.Done(server, time.Since(start))
+		// Requests the client gave up on or that ran out of the total time
+		// are not failures of the server.
+		if ctx.Err() == nil {
+			b.outliers.report(server, aborted || err != nil || status >= http.StatusInternalServerError)
 		}
-	}
+	}()
+	status, err = b.proxy.forward(tryCtx, server, rw, r, t)
+	aborted = false
+	return err
+}
 
-	if len(healthyServers) == 0 {
-		return "", errors.New("no healthy servers")
+// without returns a copy of the pool with the server marked unhealthy.
+func without(pool []Server, server string) []Server {
+	pool = append([]Server(nil), pool...)
+	for i := range pool {
+		if pool[i].name == server {
+			pool[i].isHealthy = false
+		}
 	}
-
-	serverIndex := sum % uint32(len(healthyServers))
-	return healthyServers[serverIndex], nil
+	return pool
 }
 
 func main() {
+	flag.Var(&routes, "route-timeout", "timeouts of paths starting with a prefix, e.g. /upload:connect=1s,header=30s,total=5m; can be repeated")
 	flag.Parse()
+	strategy, err := newStrategy(*strategyName)
+	if err != nil {
+		log.Fatalf("Failed to create balancing strategy: %s", err)
+	}
+	clients, err := newClientIdentity(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid trusted proxies: %s", err)
+	}
 
-	for i := range serversPool {
-		i := i
-		go func() {
-			for range time.Tick(10 * time.Second) {
-				server := serversPool[i].name
-				isHealthy := health(server)
-				serversPool[i].isHealthy = isHealthy
-				log.Println(server, isHealthy)
-			}
-		}()
+	ctx := signal.TerminationContext()
+	var conf *lbconfig.Config
+	if *configPath != "" {
+		conf, err = lbconfig.Load(*configPath)
+	} else {
+		conf, err = lbconfig.FromList(*backends, lbconfig.HealthCheck{
+			Path:         *healthPath,
+			Interval:     lbconfig.Duration(*healthInterval),
+			Jitter:       lbconfig.Duration(*healthJitter),
+			Timeout:      lbconfig.Duration(*healthTimeout),
+			Rise:         *healthRise,
+			Fall:         *healthFall,
+			ExpectStatus: *healthStatus,
+			ExpectBody:   *healthBody,
+		})
+	}
+	if err != nil {
+		log.Fatalf("Failed to load backends: %s", err)
+	}
+	pool := newPool(health)
+	pool.Apply(conf)
+	defer pool.Close()
+	if *configPath != "" {
+		go lbconfig.Watch(ctx, *configPath, 2*time.Second, pool.Apply)
+	}
+
+	outliers := newOutliers(*outlierFailures, *outlierEjection, *outlierMaxEjection)
+	stats := statsHandler(pool, outliers)
+
+	lb := &balancer{
+		pool:       pool,
+		strategy:   strategy,
+		clients:    clients,
+		outliers:   outliers,
+		proxy:      newProxy(clients, newTransport(*idleConnsPerHost)),
+		timeouts: timeouts{
+			connect:        *connectTimeout,
+			responseHeader: *responseHeaderTimeout,
+			total:          time.Duration(*timeoutSec) * time.Second,
+		},
+		routes:     routes,
+		tryTimeout: *tryTimeout,
+		retries:    *retries,
+		budget:     newRetryBudget(*retryBudgetRatio, *retryBudgetMin),
+		bodyLimit:  *retryBodyLimit,
 	}
 
 	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		sum, _ := hash(r.RemoteAddr)
-		if *traceEnabled {
-			log.Printf("Client's IP: %s, hashsum: %d", r.RemoteAddr, sum)
-		}
-		server, err := balance(sum, serversPool)
-		if err != nil {
-			log.Printf("return 503, no servers avaliable")
-			rw.WriteHeader(http.StatusServiceUnavailable)
+		if *statsPath != "" && r.URL.Path == *statsPath {
+			stats.ServeHTTP(rw, r)
 			return
 		}
-		forward(server, rw, r)
-	}))
+		lb.ServeHTTP(rw, r)
+	}), httptools.WithTLS(*tlsCert, *tlsKey), httptools.WithClientCA(*tlsClientCA))
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
+	log.Printf("Balancing strategy: %s", *strategyName)
 	frontend.Start()
-	signal.WaitForTerminationSignal()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := frontend.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down the server: %s", err)
+	}
 }
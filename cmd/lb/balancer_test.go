@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 type BalancerTestCase struct {
@@ -12,314 +13,327 @@ type BalancerTestCase struct {
 	Error bool
 }
 
-func (c BalancerTestCase) test(t *testing.T) {
-	server, err := balance(c.Hash, c.Pool)
-	require.Equal(t, c.Server, server)
+// test checks that the strategy chooses a healthy server. Sticky strategies
+// must choose the same server for the same client again.
+func (c BalancerTestCase) test(t *testing.T, strategy Strategy, sticky bool) {
+	server, err := strategy.Choose(c.Hash, c.Pool)
 	require.Equal(t, c.Error, err != nil)
+	if c.Error {
+		require.Equal(t, c.Server, server)
+		return
+	}
+
+	var names []string
+	for _, s := range healthy(c.Pool) {
+		names = append(names, s.name)
+	}
+	require.Contains(t, names, server)
+	strategy.Done(server, time.Millisecond)
+
+	if sticky {
+		again, err := strategy.Choose(c.Hash, c.Pool)
+		require.NoError(t, err)
+		require.Equal(t, server, again)
+	}
 }
 
 func TestBalancer(t *testing.T) {
-	for _, testCase := range []BalancerTestCase{
-		{
-			Hash:   0,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: true,
-				},
-			},
-			Server: "server1",
-			Error:  false,
-		},
-		{
-			Hash:   1,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: true,
-				},
-			},
-			Server: "server2",
-			Error:  false,
-		},
-		{
-			Hash:   2,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: true,
-				},
-			},
-			Server: "server3",
-			Error:  false,
+	for name := range strategies {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			strategy, err := newStrategy(name)
+			require.NoError(t, err)
+			for _, testCase := range balancerTestCases {
+				testCase.test(t, strategy, name == "ip-hash")
+			}
+		})
+	}
+}
+
+var balancerTestCases = []BalancerTestCase{
+	{
+		Hash:   0,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: true,
+			},
 		},
-		{
-			Hash:   3,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: true,
-				},
-			},
-			Server: "server1",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   1,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: true,
+			},
 		},
-		{
-			Hash:   0,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "server1",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   2,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: true,
+			},
 		},
-		{
-			Hash:   1,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "server2",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   3,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: true,
+			},
 		},
-		{
-			Hash:   2,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "server1",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   0,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-		{
-			Hash:   3,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "server2",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   1,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-		{
-			Hash:   0,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: false,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "server1",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   2,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-		{
-			Hash:   1,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: false,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "server1",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   3,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-		{
-			Hash:   2,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: false,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "server1",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   0,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: false,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-		{
-			Hash:   0,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "server1",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   1,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: false,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-		{
-			Hash:   1,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "server2",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   2,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: false,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-		{
-			Hash:   2,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: true,
-				},
-				{
-					name:      "server2",
-					isHealthy: true,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "server1",
-			Error:  false,
+		Error:  false,
+	},
+	{
+		Hash:   0,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-		{
-			Hash:   0,
-			Pool:   []Server{
-				{
-					name:      "server1",
-					isHealthy: false,
-				},
-				{
-					name:      "server2",
-					isHealthy: false,
-				},
-				{
-					name:      "server3",
-					isHealthy: false,
-				},
-			},
-			Server: "",
-			Error:  true,
+		Error:  false,
+	},
+	{
+		Hash:   1,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-		{
-			Hash: 0,
-			Pool:   []Server{},
-			Server: "",
-			Error:  true,
+		Error:  false,
+	},
+	{
+		Hash:   2,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: true,
+			},
+			{
+				name:      "server2",
+				isHealthy: true,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-		{
-			Hash: 0,
-			Pool:   nil,
-			Server: "",
-			Error:  true,
+		Error:  false,
+	},
+	{
+		Hash:   0,
+		Pool:   []Server{
+			{
+				name:      "server1",
+				isHealthy: false,
+			},
+			{
+				name:      "server2",
+				isHealthy: false,
+			},
+			{
+				name:      "server3",
+				isHealthy: false,
+			},
 		},
-	} {
-		testCase.test(t)
-	}
+		Server: "",
+		Error:  true,
+	},
+	{
+		Hash: 0,
+		Pool:   []Server{},
+		Server: "",
+		Error:  true,
+	},
+	{
+		Hash: 0,
+		Pool:   nil,
+		Server: "",
+		Error:  true,
+	},
 }
 
 type HashTestCase struct {
@@ -329,9 +343,11 @@ type HashTestCase struct {
 }
 
 func (c HashTestCase) test(t *testing.T) {
-	sum, err := hash(c.Ip)
-	require.Equal(t, c.Hash, sum)
-	require.Equal(t, c.Error, err != nil)
+	ip, err := parseIP(c.Ip)
+	require.Equal(t, c.Error, err != nil, c.Ip)
+	if err == nil {
+		require.Equal(t, c.Hash, hashIP(ip), c.Ip)
+	}
 }
 
 func TestHash(t *testing.T) {
@@ -371,6 +387,31 @@ func TestHash(t *testing.T) {
 			Error: true,
 			Hash:  0,
 		},
+		{
+			Ip:    "[::1]:1234",
+			Error: false,
+			Hash:  0x68691772,
+		},
+		{
+			Ip:    "2001:db8::1",
+			Error: false,
+			Hash:  0x6E5B04F4,
+		},
+		{
+			Ip:    "[fe80::1%eth0]:80",
+			Error: false,
+			Hash:  0xE08432E8,
+		},
+		{
+			Ip:    "[::ffff:10.0.0.5]:8080",
+			Error: false,
+			Hash:  0x500000A,
+		},
+		{
+			Ip:    "[::1",
+			Error: true,
+			Hash:  0,
+		},
 	} {
 		testCase.test(t)
 	}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseIP parses an address with or without port, e.g. 10.0.0.5:8080,
+// [::1]:1234, ::1 or [2001:db8::1].
+func parseIP(addr string) (net.IP, error) {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	// Zones of link-local addresses do not identify clients.
+	if i := strings.IndexByte(host, '%'); i != -1 {
+		host = host[:i]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", addr)
+	}
+	return ip, nil
+}
+
+// hashIP returns the hash of the client address. IPv4 addresses, including
+// IPv4-mapped IPv6 ones, are packed into the hash as is.
+func hashIP(ip net.IP) uint32 {
+	if v4 := ip.To4(); v4 != nil {
+		var sum uint32
+		for i, octet := range v4 {
+			sum += uint32(octet) << (i * 8)
+		}
+		return sum
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write(ip.To16())
+	return h.Sum32()
+}
+
+// clientIdentity finds the address of the client of a request. Forwarded and
+// X-Forwarded-For headers are used only when they are set by trusted proxies.
+type clientIdentity struct {
+	trusted []*net.IPNet
+}
+
+// newClientIdentity creates clientIdentity trusting comma separated CIDRs,
+// e.g. 10.0.0.0/8,fd00::/8.
+func newClientIdentity(trustedProxies string) (*clientIdentity, error) {
+	c := new(clientIdentity)
+	for _, cidr := range strings.Split(trustedProxies, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		c.trusted = append(c.trusted, network)
+	}
+	return c, nil
+}
+
+func (c *clientIdentity) isTrusted(ip net.IP) bool {
+	for _, network := range c.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ip returns the client address. If the request came from a trusted proxy,
+// the forwarding chain is walked from the nearest hop until an address that
+// is not a trusted proxy.
+func (c *clientIdentity) ip(r *http.Request) (net.IP, error) {
+	ip, err := parseIP(r.RemoteAddr)
+	if err != nil || !c.isTrusted(ip) {
+		return ip, err
+	}
+
+	chain := forwardedFor(r.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop, err := parseIP(chain[i])
+		if err != nil {
+			// Obfuscated or unknown hops can not be followed.
+			return ip, nil
+		}
+		ip = hop
+		if !c.isTrusted(ip) {
+			break
+		}
+	}
+	return ip, nil
+}
+
+// forwardedFor returns client addresses of the Forwarded header or, if it is
+// absent, of the X-Forwarded-For header, from the original client to the
+// nearest proxy.
+func forwardedFor(h http.Header) []string {
+	var chain []string
+	for _, value := range h.Values("forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					chain = append(chain, strings.Trim(pair[4:], `"`))
+				}
+			}
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+
+	for _, value := range h.Values("x-forwarded-for") {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				chain = append(chain, addr)
+			}
+		}
+	}
+	return chain
+}
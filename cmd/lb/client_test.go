@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type ClientIdentityTestCase struct {
+	Name          string
+	RemoteAddr    string
+	Forwarded     string
+	XForwardedFor string
+	Ip            string
+}
+
+func TestClientIdentity(t *testing.T) {
+	clients, err := newClientIdentity("10.0.0.0/8, fd00::/8")
+	require.NoError(t, err)
+
+	for _, c := range []ClientIdentityTestCase{
+		{
+			Name:          "untrusted peer",
+			RemoteAddr:    "192.0.2.1:1234",
+			XForwardedFor: "198.51.100.7",
+			Ip:            "192.0.2.1",
+		},
+		{
+			Name:       "ipv6 peer",
+			RemoteAddr: "[2001:db8::1]:1234",
+			Ip:         "2001:db8::1",
+		},
+		{
+			Name:          "trusted proxy",
+			RemoteAddr:    "10.0.0.2:1234",
+			XForwardedFor: "198.51.100.7",
+			Ip:            "198.51.100.7",
+		},
+		{
+			Name:          "spoofed chain",
+			RemoteAddr:    "10.0.0.2:1234",
+			XForwardedFor: "203.0.113.9, 198.51.100.7, 10.1.1.1",
+			Ip:            "198.51.100.7",
+		},
+		{
+			Name:          "only trusted hops",
+			RemoteAddr:    "10.0.0.2:1234",
+			XForwardedFor: "10.1.1.1",
+			Ip:            "10.1.1.1",
+		},
+		{
+			Name:          "forwarded header",
+			RemoteAddr:    "[fd00::2]:1234",
+			Forwarded:     `for=198.51.100.7;proto=https, For="[2001:db8::7]:4711"`,
+			XForwardedFor: "203.0.113.9",
+			Ip:            "2001:db8::7",
+		},
+		{
+			Name:       "obfuscated hop",
+			RemoteAddr: "10.0.0.2:1234",
+			Forwarded:  "for=_hidden",
+			Ip:         "10.0.0.2",
+		},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.RemoteAddr
+		if c.Forwarded != "" {
+			r.Header.Set("forwarded", c.Forwarded)
+		}
+		if c.XForwardedFor != "" {
+			r.Header.Set("x-forwarded-for", c.XForwardedFor)
+		}
+
+		ip, err := clients.ip(r)
+		require.NoError(t, err, c.Name)
+		require.Equal(t, c.Ip, ip.String(), c.Name)
+	}
+
+	_, err = newClientIdentity("10.0.0.0")
+	require.Error(t, err)
+}
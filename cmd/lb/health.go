@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/lbconfig"
+)
+
+// maxHealthBody is the part of health check responses searched for the
+// expected body.
+const maxHealthBody = 64 << 10
+
+// health checks the server once and returns the reason it is unhealthy, or
+// nil if it is healthy.
+func health(dst string, hc lbconfig.HealthCheck) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(hc.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s://%s%s", scheme(), dst, hc.Path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The rest of the body is read so that the connection can be reused.
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+	}
+	if resp.StatusCode != hc.ExpectStatus {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, hc.ExpectStatus)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if hc.ExpectBody != "" && !bytes.Contains(body, []byte(hc.ExpectBody)) {
+		return fmt.Errorf("response does not contain %q", hc.ExpectBody)
+	}
+	return nil
+}
+
+// healthCheck returns the health check of the server if it is in the pool.
+func (p *Pool) healthCheck(name string) (lbconfig.HealthCheck, bool) {
+	for _, server := range p.Servers() {
+		if server.name == name {
+			return server.health, true
+		}
+	}
+	return lbconfig.HealthCheck{}, false
+}
+
+// healthState counts results of health checks of a server in a row.
+type healthState struct {
+	checked        bool
+	passed, failed int
+}
+
+// update counts the result of a check. It returns the new health state and
+// its reason if the state is decided: by the first check, or when the rise
+// or fall threshold is reached.
+func (s *healthState) update(err error, hc lbconfig.HealthCheck) (isHealthy bool, reason string, decided bool) {
+	first := !s.checked
+	s.checked = true
+	if err == nil {
+		s.passed, s.failed = s.passed+1, 0
+	} else {
+		s.passed, s.failed = 0, s.failed+1
+	}
+
+	switch {
+	case first && err == nil:
+		return true, "first check passed", true
+	case first:
+		return false, fmt.Sprintf("first check failed: %s", err), true
+	case err == nil && s.passed >= hc.Rise:
+		return true, fmt.Sprintf("%d checks passed", s.passed), true
+	case err != nil && s.failed >= hc.Fall:
+		return false, fmt.Sprintf("%d checks failed, last: %s", s.failed, err), true
+	}
+	return false, "", false
+}
+
+// checkHealth checks the server once immediately and then every interval
+// until stop is closed. Settings are looked up before every check, so
+// reloaded configs apply to running checks.
+func (p *Pool) checkHealth(name string, stop chan struct{}) {
+	var state healthState
+	for {
+		hc, ok := p.healthCheck(name)
+		if !ok {
+			return
+		}
+		if isHealthy, reason, ok := state.update(p.check(name, hc), hc); ok {
+			p.setHealth(name, isHealthy, reason)
+		}
+
+		wait := time.Duration(hc.Interval)
+		if hc.Jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(hc.Jitter)))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/lbconfig"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			rw.Write([]byte(`{"status": "ok"}`))
+		case "/degraded":
+			rw.Write([]byte(`{"status": "degraded"}`))
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/created":
+			rw.WriteHeader(http.StatusCreated)
+		default:
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	dst := strings.TrimPrefix(backend.URL, "http://")
+
+	for _, tc := range []struct {
+		hc    lbconfig.HealthCheck
+		error string
+	}{
+		{hc: lbconfig.HealthCheck{Path: "/health"}},
+		{hc: lbconfig.HealthCheck{Path: "/health", ExpectBody: `"ok"`}},
+		{hc: lbconfig.HealthCheck{Path: "/degraded", ExpectBody: `"ok"`}, error: "does not contain"},
+		{hc: lbconfig.HealthCheck{Path: "/broken"}, error: "status 500, expected 200"},
+		{hc: lbconfig.HealthCheck{Path: "/created"}, error: "status 201, expected 200"},
+		{hc: lbconfig.HealthCheck{Path: "/created", ExpectStatus: http.StatusCreated}},
+		{hc: lbconfig.HealthCheck{Path: "/slow", Timeout: lbconfig.Duration(10 * time.Millisecond)}, error: "deadline"},
+	} {
+		conf, err := lbconfig.FromList(dst, tc.hc)
+		require.NoError(t, err)
+		err = health(dst, conf.Backends[0].Health)
+		if tc.error == "" {
+			require.NoError(t, err, tc.hc.Path)
+		} else {
+			require.Error(t, err, tc.hc.Path)
+			require.Contains(t, err.Error(), tc.error)
+		}
+	}
+}
+
+func TestHealthState(t *testing.T) {
+	hc := lbconfig.HealthCheck{Rise: 2, Fall: 3}
+	down := errors.New("down")
+
+	type step struct {
+		err       error
+		isHealthy bool
+		decided   bool
+	}
+	var state healthState
+	for i, s := range []step{
+		// The first check decides the state right away.
+		{err: down, isHealthy: false, decided: true},
+		{err: nil},
+		{err: down},
+		{err: nil},
+		{err: nil, isHealthy: true, decided: true},
+		{err: down},
+		{err: down},
+		// Counters start over after a different result.
+		{err: nil},
+		{err: down},
+		{err: down},
+		{err: down, isHealthy: false, decided: true},
+	} {
+		isHealthy, reason, decided := state.update(s.err, hc)
+		require.Equal(t, s.decided, decided, "step %d", i)
+		require.Equal(t, s.isHealthy, isHealthy, "step %d", i)
+		require.Equal(t, decided, reason != "", "step %d", i)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// outliers ejects servers failing requests from balancing. A server is
+// ejected after the configured number of errors or 5xx responses in a row,
+// every next ejection lasts twice as long as the previous one, up to the
+// maximum. Servers that serve requests well for as long as their last
+// ejection lasted start over from the base ejection time.
+type outliers struct {
+	mu      sync.Mutex
+	servers map[string]*outlier
+
+	// failures in a row eject a server, zero disables ejection.
+	failures    int
+	ejection    time.Duration
+	maxEjection time.Duration
+	now         func() time.Time
+}
+
+type outlier struct {
+	// failures counts failed requests in a row.
+	failures int
+	// ejections counts ejections since the server was last fine.
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func newOutliers(failures int, ejection, maxEjection time.Duration) *outliers {
+	return &outliers{
+		servers:     make(map[string]*outlier),
+		failures:    failures,
+		ejection:    ejection,
+		maxEjection: maxEjection,
+		now:         time.Now,
+	}
+}
+
+// ejectionTime returns how long the server is ejected for the n-th time.
+func (o *outliers) ejectionTime(n int) time.Duration {
+	d := o.ejection
+	for i := 1; i < n && d < o.maxEjection; i++ {
+		d *= 2
+	}
+	if d > o.maxEjection {
+		d = o.maxEjection
+	}
+	return d
+}
+
+// report counts the result of a request forwarded to the server.
+func (o *outliers) report(server string, failed bool) {
+	if o.failures <= 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	s, ok := o.servers[server]
+	if !ok {
+		s = new(outlier)
+		o.servers[server] = s
+	}
+	now := o.now()
+	if !failed {
+		s.failures = 0
+		if s.ejections > 0 && !now.Before(s.ejectedUntil.Add(o.ejectionTime(s.ejections))) {
+			s.ejections = 0
+		}
+		return
+	}
+
+	s.failures++
+	// Requests started before the ejection do not extend it.
+	if s.failures < o.failures || now.Before(s.ejectedUntil) {
+		return
+	}
+	s.failures = 0
+	s.ejections++
+	d := o.ejectionTime(s.ejections)
+	s.ejectedUntil = now.Add(d)
+	log.Printf("Server %s is ejected for %s after %d failed requests", server, d, o.failures)
+}
+
+// state returns the outlier state of the server and whether it is ejected now.
+func (o *outliers) state(server string) (outlier, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s, ok := o.servers[server]
+	if !ok {
+		return outlier{}, false
+	}
+	return *s, o.now().Before(s.ejectedUntil)
+}
+
+// filter returns the pool with ejected servers marked unhealthy. Servers are
+// not ejected if none of them would be left healthy.
+func (o *outliers) filter(pool []Server) []Server {
+	if o.failures <= 0 {
+		return pool
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+	var filtered []Server
+	left := false
+	for i, server := range pool {
+		if !server.isHealthy {
+			continue
+		}
+		if s, ok := o.servers[server.name]; !ok || !now.Before(s.ejectedUntil) {
+			left = true
+			continue
+		}
+		if filtered == nil {
+			filtered = append([]Server(nil), pool...)
+		}
+		filtered[i].isHealthy = false
+	}
+	if filtered == nil || !left {
+		return pool
+	}
+	return filtered
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/lbconfig"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is the time of outliers in tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestOutliers(clock *fakeClock) *outliers {
+	o := newOutliers(3, time.Second, 5*time.Second)
+	o.now = clock.Now
+	return o
+}
+
+func TestOutliers_Ejection(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	o := newTestOutliers(clock)
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			o.report("server1", true)
+		}
+	}
+	ejected := func() bool {
+		_, ejected := o.state("server1")
+		return ejected
+	}
+
+	// Failures must be in a row.
+	fail(2)
+	o.report("server1", false)
+	fail(2)
+	require.False(t, ejected())
+
+	// Every next ejection lasts twice as long, up to the maximum.
+	for _, d := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		fail(3)
+		require.True(t, ejected())
+		clock.now = clock.now.Add(d - time.Millisecond)
+		require.True(t, ejected(), "ejection for %s", d)
+		clock.now = clock.now.Add(time.Millisecond)
+		require.False(t, ejected(), "ejection for %s", d)
+	}
+	state, _ := o.state("server1")
+	require.Equal(t, 5, state.ejections)
+
+	// Serving requests well for as long as the last ejection resets it.
+	clock.now = clock.now.Add(5 * time.Second)
+	o.report("server1", false)
+	state, _ = o.state("server1")
+	require.Zero(t, state.ejections)
+	fail(3)
+	clock.now = clock.now.Add(time.Second)
+	require.False(t, ejected())
+}
+
+func TestOutliers_Filter(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	o := newTestOutliers(clock)
+	pool := []Server{
+		{name: "server1", isHealthy: true},
+		{name: "server2", isHealthy: true},
+		{name: "server3", isHealthy: false},
+	}
+
+	require.Equal(t, pool, o.filter(pool))
+	for i := 0; i < 3; i++ {
+		o.report("server1", true)
+	}
+	filtered := o.filter(pool)
+	require.Equal(t, []Server{
+		{name: "server1", isHealthy: false},
+		{name: "server2", isHealthy: true},
+		{name: "server3", isHealthy: false},
+	}, filtered)
+	require.True(t, pool[0].isHealthy, "the pool must not be modified")
+
+	// The last healthy server is never ejected.
+	for i := 0; i < 3; i++ {
+		o.report("server2", true)
+	}
+	require.Equal(t, pool, o.filter(pool))
+
+	o = newOutliers(0, time.Second, time.Second)
+	for i := 0; i < 10; i++ {
+		o.report("server1", true)
+	}
+	require.Equal(t, pool, o.filter(pool))
+}
+
+func TestBalancer_OutlierReports(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	for _, c := range []struct {
+		name    string
+		setup   func(b *balancer)
+		cancel  bool
+		ejected bool
+	}{
+		{name: "client gone", cancel: true},
+		{name: "total timeout", setup: func(b *balancer) { b.timeouts.total = 50 * time.Millisecond }},
+		{name: "try timeout", setup: func(b *balancer) { b.tryTimeout = 50 * time.Millisecond }, ejected: true},
+	} {
+		b := newTestBalancer(t, backendAddr(slow))
+		b.retries = 0
+		b.outliers = newOutliers(1, time.Minute, time.Minute)
+		if c.setup != nil {
+			c.setup(b)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil)
+		if c.cancel {
+			ctx, cancel := context.WithTimeout(r.Context(), 50*time.Millisecond)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		b.ServeHTTP(httptest.NewRecorder(), r)
+		_, ejected := b.outliers.state(backendAddr(slow))
+		require.Equal(t, c.ejected, ejected, c.name)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	pool := newPool(func(string, lbconfig.HealthCheck) error { return nil })
+	defer pool.Close()
+	conf, err := lbconfig.FromList("server1:8080=2,server2:8080", lbconfig.HealthCheck{
+		Interval: lbconfig.Duration(time.Hour),
+	})
+	require.NoError(t, err)
+	pool.Apply(conf)
+
+	clock := &fakeClock{now: time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)}
+	o := newTestOutliers(clock)
+	for i := 0; i < 4; i++ {
+		o.report("server2:8080", true)
+	}
+
+	rw := httptest.NewRecorder()
+	statsHandler(pool, o).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/lb/stats", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	var stats []serverStats
+	require.NoError(t, json.NewDecoder(rw.Body).Decode(&stats))
+	until := clock.now.Add(time.Second)
+	require.Equal(t, []serverStats{
+		{Name: "server1:8080", Healthy: true, Weight: 2},
+		{Name: "server2:8080", Healthy: true, Weight: 1, Ejected: true, Ejections: 1, EjectedUntil: &until, Failures: 1},
+	}, stats)
+}
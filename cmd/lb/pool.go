@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/lbconfig"
+)
+
+// Pool holds the servers of the balancer and checks their health.
+// The slice of servers is replaced as a whole on every change, so requests
+// can keep using the slice they got without locking.
+type Pool struct {
+	mu      sync.RWMutex
+	servers []Server
+	// stops stop health checks of servers removed from the pool.
+	stops map[string]chan struct{}
+
+	// check returns the reason the server is unhealthy, or nil.
+	check func(dst string, hc lbconfig.HealthCheck) error
+}
+
+// newPool creates an empty pool checking health of its servers with check.
+func newPool(check func(dst string, hc lbconfig.HealthCheck) error) *Pool {
+	return &Pool{
+		stops: make(map[string]chan struct{}),
+		check: check,
+	}
+}
+
+// Servers returns the current servers. The slice must not be modified.
+func (p *Pool) Servers() []Server {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.servers
+}
+
+// Apply replaces the servers with backends of the config. Servers that stay
+// in the pool keep their health state, new ones are checked right away.
+func (p *Pool) Apply(conf *lbconfig.Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := make(map[string]Server, len(p.servers))
+	for _, server := range p.servers {
+		old[server.name] = server
+	}
+
+	servers := make([]Server, 0, len(conf.Backends))
+	for _, b := range conf.Backends {
+		server := Server{
+			name:      b.Address,
+			isHealthy: true,
+			weight:    b.Weight,
+			health:    b.Health,
+		}
+		if o, ok := old[b.Address]; ok {
+			server.isHealthy = o.isHealthy
+			delete(old, b.Address)
+		} else {
+			stop := make(chan struct{})
+			p.stops[server.name] = stop
+			go p.checkHealth(server.name, stop)
+			log.Printf("Added server %s", server.name)
+		}
+		servers = append(servers, server)
+	}
+
+	for name := range old {
+		close(p.stops[name])
+		delete(p.stops, name)
+		log.Printf("Removed server %s", name)
+	}
+	p.servers = servers
+}
+
+// Close stops health checks of all servers.
+func (p *Pool) Close() {
+	p.Apply(&lbconfig.Config{})
+}
+
+// setHealth updates the health state of the server if it is still in the pool
+// and logs the change with its reason.
+func (p *Pool) setHealth(name string, isHealthy bool, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	servers := append([]Server(nil), p.servers...)
+	for i := range servers {
+		if servers[i].name == name && servers[i].isHealthy != isHealthy {
+			servers[i].isHealthy = isHealthy
+			if isHealthy {
+				log.Printf("Server %s is healthy: %s", name, reason)
+			} else {
+				log.Printf("Server %s is unhealthy: %s", name, reason)
+			}
+		}
+	}
+	p.servers = servers
+}
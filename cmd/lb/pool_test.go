@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/lbconfig"
+	"github.com/stretchr/testify/require"
+)
+
+// waitHealth waits until the server has the expected health state.
+func waitHealth(t *testing.T, pool *Pool, name string, isHealthy bool) {
+	require.Eventually(t, func() bool {
+		for _, server := range pool.Servers() {
+			if server.name == name {
+				return server.isHealthy == isHealthy
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+}
+
+func TestPool_Apply(t *testing.T) {
+	var down sync.Map
+	down.Store("server2:8080", true)
+	pool := newPool(func(dst string, hc lbconfig.HealthCheck) error {
+		if _, ok := down.Load(dst); ok {
+			return errors.New("down")
+		}
+		return nil
+	})
+	defer pool.Close()
+
+	hc := lbconfig.HealthCheck{Interval: lbconfig.Duration(time.Hour)}
+	conf, err := lbconfig.FromList("server1:8080,server2:8080", hc)
+	require.NoError(t, err)
+	pool.Apply(conf)
+	// Servers are checked right away rather than after the first interval.
+	waitHealth(t, pool, "server2:8080", false)
+
+	before := pool.Servers()
+	hc.Path = "/ping"
+	conf, err = lbconfig.FromList("server2:8080=2,server3:8080", hc)
+	require.NoError(t, err)
+	pool.Apply(conf)
+
+	health := conf.Backends[0].Health
+	require.Equal(t, "/ping", health.Path)
+	require.Equal(t, []Server{
+		{name: "server2:8080", isHealthy: false, weight: 2, health: health},
+		{name: "server3:8080", isHealthy: true, weight: 1, health: health},
+	}, pool.Servers())
+	// Requests in flight keep the servers they got.
+	require.Len(t, before, 2)
+	require.Equal(t, "server1:8080", before[0].name)
+
+	require.Len(t, pool.stops, 2)
+	pool.Close()
+	require.Empty(t, pool.stops)
+	require.Empty(t, pool.Servers())
+}
+
+// TestPool_ConcurrentHealth is meant to be run with -race: health state
+// changes all the time while every strategy balances requests.
+func TestPool_ConcurrentHealth(t *testing.T) {
+	var checks uint32
+	pool := newPool(func(dst string, hc lbconfig.HealthCheck) error {
+		if atomic.AddUint32(&checks, 1)%2 == 0 {
+			return errors.New("down")
+		}
+		return nil
+	})
+	defer pool.Close()
+
+	conf, err := lbconfig.FromList("server1:8080,server2:8080=2,server3:8080", lbconfig.HealthCheck{
+		Interval: lbconfig.Duration(time.Microsecond),
+		Rise:     1,
+		Fall:     1,
+	})
+	require.NoError(t, err)
+	pool.Apply(conf)
+
+	var wg sync.WaitGroup
+	for name := range strategies {
+		strategy, err := newStrategy(name)
+		require.NoError(t, err)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for n := 0; n < 1000; n++ {
+					server, err := strategy.Choose(uint32(i*n), pool.Servers())
+					if err == nil {
+						strategy.Done(server, time.Millisecond)
+					}
+				}
+			}(i)
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 100; n++ {
+			pool.Apply(conf)
+		}
+	}()
+	wg.Wait()
+
+	require.NotZero(t, atomic.LoadUint32(&checks))
+}
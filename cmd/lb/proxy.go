@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httputil"
+)
+
+// newTransport creates the transport shared by all requests to backends,
+// keeping up to idlePerHost idle connections to every backend.
+func newTransport(idlePerHost int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialContext
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = idlePerHost
+	return transport
+}
+
+// try is a request forwarded to a backend.
+type try struct {
+	dst    string
+	status int
+	err    error
+}
+
+type tryKey struct{}
+
+// proxy forwards requests to backends. Hop-by-hop headers, trailers,
+// upgraded connections and flushing of streamed responses are handled by
+// httputil.ReverseProxy.
+type proxy struct {
+	clients *clientIdentity
+	rp      *httputil.ReverseProxy
+}
+
+func newProxy(clients *clientIdentity, transport http.RoundTripper) *proxy {
+	p := &proxy{clients: clients}
+	p.rp = &httputil.ReverseProxy{
+		Director:       p.direct,
+		Transport:      &timeoutTransport{next: transport},
+		FlushInterval:  -1,
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.handleError,
+	}
+	return p
+}
+
+// forward sends the request to dst within the connect and response header
+// timeouts and writes its response. It returns the status code of the
+// response, or an error if dst did not respond, in which case nothing is
+// written.
+func (p *proxy) forward(ctx context.Context, dst string, rw http.ResponseWriter, r *http.Request, t timeouts) (int, error) {
+	tr := &try{dst: dst}
+	ctx = withConnectTimeout(ctx, t.connect)
+	ctx = withResponseHeaderTimeout(ctx, t.responseHeader)
+	p.rp.ServeHTTP(rw, r.WithContext(context.WithValue(ctx, tryKey{}, tr)))
+	if tr.status != 0 {
+		// The response may be cut short, but it cannot be sent again.
+		return tr.status, nil
+	}
+	return 0, tr.err
+}
+
+// direct points the request to the backend. X-Forwarded-* and Forwarded
+// headers are kept only if they are set by a trusted proxy, X-Forwarded-For
+// is then appended with the address of the peer by the reverse proxy.
+func (p *proxy) direct(req *http.Request) {
+	tr := req.Context().Value(tryKey{}).(*try)
+
+	peer, err := parseIP(req.RemoteAddr)
+	if err != nil || !p.clients.isTrusted(peer) {
+		for _, h := range []string{"forwarded", "x-forwarded-for", "x-forwarded-host", "x-forwarded-proto"} {
+			req.Header.Del(h)
+		}
+	}
+	if req.Header.Get("x-forwarded-host") == "" {
+		req.Header.Set("x-forwarded-host", req.Host)
+	}
+	if req.Header.Get("x-forwarded-proto") == "" {
+		if req.TLS != nil {
+			req.Header.Set("x-forwarded-proto", "https")
+		} else {
+			req.Header.Set("x-forwarded-proto", "http")
+		}
+	}
+
+	req.URL.Scheme = scheme()
+	req.URL.Host = tr.dst
+	req.Host = tr.dst
+}
+
+func (p *proxy) modifyResponse(resp *http.Response) error {
+	tr := resp.Request.Context().Value(tryKey{}).(*try)
+	tr.status = resp.StatusCode
+	if longLived(resp) {
+		stopTotalTimeout(resp.Request.Context())
+	}
+	if *traceEnabled {
+		resp.Header.Set("lb-from", tr.dst)
+	}
+	log.Println("fwd", resp.StatusCode, resp.Request.URL)
+	return nil
+}
+
+// handleError records the error of the try, the response is written by the
+// balancer if the request is not retried.
+func (p *proxy) handleError(_ http.ResponseWriter, req *http.Request, err error) {
+	tr := req.Context().Value(tryKey{}).(*try)
+	tr.err = err
+	log.Printf("Failed to get response from %s: %s", tr.dst, err)
+}
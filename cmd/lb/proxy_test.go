@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// echoHeaders responds with the headers of the request as JSON.
+var echoHeaders = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+	r.Header.Set("host", r.Host)
+	json.NewEncoder(rw).Encode(r.Header)
+})
+
+// newTestProxy starts the balancer of the backend trusting proxies from
+// trustedProxies and changed by setup. All requests come from 127.0.0.1.
+func newTestProxy(t *testing.T, backend http.Handler, trustedProxies string, setup ...func(b *balancer)) (*httptest.Server, string) {
+	b := httptest.NewServer(backend)
+	t.Cleanup(b.Close)
+
+	lb := newTestBalancer(t, backendAddr(b))
+	clients, err := newClientIdentity(trustedProxies)
+	require.NoError(t, err)
+	lb.clients = clients
+	lb.proxy = newProxy(clients, newTransport(2))
+	// Responses, upgraded ones included, pass the response header timeout.
+	lb.timeouts.responseHeader = time.Second
+	for _, f := range setup {
+		f(lb)
+	}
+
+	s := httptest.NewServer(lb)
+	t.Cleanup(s.Close)
+	return s, backendAddr(b)
+}
+
+type ProxyHeaderTestCase struct {
+	Name           string
+	TrustedProxies string
+	Request        http.Header
+	// Expected headers of the request received by the backend, empty values
+	// must be absent.
+	Expected map[string]string
+}
+
+func (c ProxyHeaderTestCase) test(t *testing.T) {
+	s, backend := newTestProxy(t, echoHeaders, c.TrustedProxies)
+
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/api/v1/some-data", nil)
+	require.NoError(t, err)
+	req.Host = "example.com"
+	for k, values := range c.Request {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, c.Name)
+
+	var received http.Header
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&received))
+	for k, v := range c.Expected {
+		if v == "{backend}" {
+			v = backend
+		}
+		require.Equal(t, v, received.Get(k), "%s: %s", c.Name, k)
+	}
+}
+
+func TestProxy_RequestHeaders(t *testing.T) {
+	for _, c := range []ProxyHeaderTestCase{
+		{
+			Name: "hop-by-hop",
+			Request: http.Header{
+				"Connection":          {"X-Hop"},
+				"X-Hop":               {"1"},
+				"Keep-Alive":          {"timeout=5"},
+				"Proxy-Authorization": {"Basic Zm9vOmJhcg=="},
+				"Te":                  {"gzip"},
+				"Upgrade":             {"h2c"},
+				"X-End-To-End":        {"1"},
+			},
+			Expected: map[string]string{
+				"Connection":          "",
+				"X-Hop":               "",
+				"Keep-Alive":          "",
+				"Proxy-Authorization": "",
+				"Te":                  "",
+				"Upgrade":             "",
+				"X-End-To-End":        "1",
+			},
+		},
+		{
+			Name:     "host",
+			Expected: map[string]string{"Host": "{backend}", "X-Forwarded-Host": "example.com"},
+		},
+		{
+			Name: "untrusted forwarding headers",
+			Request: http.Header{
+				"X-Forwarded-For":   {"203.0.113.7"},
+				"X-Forwarded-Host":  {"evil.com"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=203.0.113.7"},
+			},
+			Expected: map[string]string{
+				"X-Forwarded-For":   "127.0.0.1",
+				"X-Forwarded-Host":  "example.com",
+				"X-Forwarded-Proto": "http",
+				"Forwarded":         "",
+			},
+		},
+		{
+			Name:           "trusted forwarding headers",
+			TrustedProxies: "127.0.0.0/8",
+			Request: http.Header{
+				"X-Forwarded-For":   {"203.0.113.7"},
+				"X-Forwarded-Host":  {"shop.example.com"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=203.0.113.7"},
+			},
+			Expected: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7, 127.0.0.1",
+				"X-Forwarded-Host":  "shop.example.com",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=203.0.113.7",
+			},
+		},
+		{
+			Name:           "trusted proxy without forwarding headers",
+			TrustedProxies: "127.0.0.0/8",
+			Expected: map[string]string{
+				"X-Forwarded-For":   "127.0.0.1",
+				"X-Forwarded-Host":  "example.com",
+				"X-Forwarded-Proto": "http",
+			},
+		},
+	} {
+		c.test(t)
+	}
+}
+
+func TestProxy_ResponseHeaders(t *testing.T) {
+	s, _ := newTestProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Connection", "X-Hop")
+		rw.Header().Set("X-Hop", "1")
+		rw.Header().Set("Keep-Alive", "timeout=5")
+		rw.Header().Set("Proxy-Authenticate", "Basic")
+		rw.Header().Set("X-End-To-End", "1")
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.Write([]byte("body"))
+		rw.Header().Set("X-Checksum", "42")
+	}), "")
+
+	resp, err := http.Get(s.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "body", string(body))
+
+	for _, h := range []string{"X-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+		require.Empty(t, resp.Header.Get(h), h)
+	}
+	require.NotContains(t, resp.Header.Get("Connection"), "X-Hop")
+	require.Equal(t, "1", resp.Header.Get("X-End-To-End"))
+	// Trailers are sent after the body.
+	require.Equal(t, "42", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestProxy_Streaming(t *testing.T) {
+	finish := make(chan struct{})
+	s, _ := newTestProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "text/event-stream")
+		rw.Write([]byte("first\n"))
+		rw.(http.Flusher).Flush()
+		<-finish
+		rw.Write([]byte("last\n"))
+	}), "", func(b *balancer) { b.timeouts.total = 100 * time.Millisecond })
+
+	resp, err := http.Get(s.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// The first part must arrive while the backend is still responding.
+	in := bufio.NewReader(resp.Body)
+	line := make(chan string, 1)
+	go func() {
+		l, _ := in.ReadString('\n')
+		line <- l
+	}()
+	select {
+	case l := <-line:
+		require.Equal(t, "first\n", l)
+	case <-time.After(time.Second):
+		close(finish)
+		t.Fatal("Streamed response was not flushed")
+	}
+
+	// Event streams outlive the total timeout.
+	time.Sleep(300 * time.Millisecond)
+	close(finish)
+	l, err := in.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "last\n", l)
+}
+
+func TestProxy_Upgrade(t *testing.T) {
+	s, _ := newTestProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		for {
+			msg, err := buf.ReadString('\n')
+			if err != nil {
+				return
+			}
+			buf.WriteString(msg)
+			buf.Flush()
+		}
+	}), "", func(b *balancer) { b.timeouts.total = 100 * time.Millisecond })
+
+	conn, err := net.Dial("tcp", backendAddr(s))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	require.NoError(t, err)
+	in := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(in, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.Equal(t, "echo", resp.Header.Get("Upgrade"))
+
+	for i, ping := range []string{"ping\n", "ping after the total timeout\n"} {
+		if i > 0 {
+			// The upgraded connection outlives the total timeout.
+			time.Sleep(300 * time.Millisecond)
+		}
+		_, err = conn.Write([]byte(ping))
+		require.NoError(t, err)
+		msg, err := in.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, ping, msg)
+	}
+}
+
+func TestProxy_AbortedBody(t *testing.T) {
+	strategy := &leastConnections{newConnections()}
+	outliers := newOutliers(1, time.Minute, time.Minute)
+	s, backend := newTestProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// The connection is dropped in the middle of the body.
+		rw.Header().Set("content-length", "100")
+		rw.Write([]byte("part"))
+		rw.(http.Flusher).Flush()
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}), "", func(b *balancer) {
+		b.strategy = strategy
+		b.outliers = outliers
+	})
+
+	resp, err := http.Get(s.URL)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Error(t, err)
+
+	// The try is accounted even though the response was aborted.
+	require.Eventually(t, func() bool {
+		strategy.Lock()
+		defer strategy.Unlock()
+		return len(strategy.active) == 0
+	}, time.Second, time.Millisecond)
+	_, ejected := outliers.state(backend)
+	require.True(t, ejected)
+}
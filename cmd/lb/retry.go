@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// retryBudget limits retries in flight to a share of requests in flight, so
+// that retries do not pile up on backends when most of them are failing.
+type retryBudget struct {
+	// Counters go first to be 64-bit aligned for atomic operations.
+	requests int64
+	retries  int64
+
+	// ratio of requests in flight that can be retried, but at least min
+	// retries are always allowed.
+	ratio float64
+	min   int64
+}
+
+func newRetryBudget(ratio float64, min int) *retryBudget {
+	return &retryBudget{ratio: ratio, min: int64(min)}
+}
+
+// request counts a request in flight until done is called.
+func (b *retryBudget) request() (done func()) {
+	atomic.AddInt64(&b.requests, 1)
+	return func() {
+		atomic.AddInt64(&b.requests, -1)
+	}
+}
+
+// retry reports whether a request can be retried. If it can, the retry is
+// counted in flight until done is called.
+func (b *retryBudget) retry() (done func(), ok bool) {
+	allowed := int64(b.ratio * float64(atomic.LoadInt64(&b.requests)))
+	if allowed < b.min {
+		allowed = b.min
+	}
+	if atomic.AddInt64(&b.retries, 1) > allowed {
+		atomic.AddInt64(&b.retries, -1)
+		return nil, false
+	}
+	return func() {
+		atomic.AddInt64(&b.retries, -1)
+	}, true
+}
+
+// replayableBody reads the body of the request if it is not larger than limit,
+// so that the request can be sent again. It returns false if the body cannot
+// be replayed, in which case it is left to be read once.
+func replayableBody(r *http.Request, limit int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, true, nil
+	}
+	if r.ContentLength < 0 || r.ContentLength > limit {
+		return nil, false, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	r.Body.Close()
+	// The body is set before every try.
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+// retryable reports whether the request that got err instead of a response
+// can be sent to another backend. Idempotent requests can always be, others
+// only if connecting to the backend failed, so that the request was not sent.
+func retryable(r *http.Request, err error) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/lbconfig"
+	"github.com/stretchr/testify/require"
+)
+
+// backendAddr returns host:port of the test server.
+func backendAddr(s *httptest.Server) string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// newTestBalancer balances requests to the backends in turn, starting with
+// the first one.
+func newTestBalancer(t *testing.T, backends ...string) *balancer {
+	pool := newPool(func(string, lbconfig.HealthCheck) error { return nil })
+	t.Cleanup(pool.Close)
+	conf, err := lbconfig.FromList(strings.Join(backends, ","), lbconfig.HealthCheck{
+		Interval: lbconfig.Duration(time.Hour),
+	})
+	require.NoError(t, err)
+	pool.Apply(conf)
+	clients, err := newClientIdentity("")
+	require.NoError(t, err)
+
+	return &balancer{
+		pool:      pool,
+		strategy:  new(roundRobin),
+		clients:   clients,
+		outliers:  newOutliers(0, 0, 0),
+		proxy:     newProxy(clients, newTransport(2)),
+		timeouts:  timeouts{total: time.Second},
+		retries:   2,
+		budget:    newRetryBudget(0.2, 3),
+		bodyLimit: 1024,
+	}
+}
+
+type RetryTestCase struct {
+	Name   string
+	Method string
+	Body   string
+	// Chunked hides the length of the body.
+	Chunked bool
+	Setup   func(b *balancer)
+	Status  int
+	// HangUpStatus is expected if the request was sent before the backend
+	// failed, zero means Status.
+	HangUpStatus int
+}
+
+func (c RetryTestCase) test(t *testing.T, backends ...string) {
+	b := newTestBalancer(t, backends...)
+	if c.Setup != nil {
+		c.Setup(b)
+	}
+
+	r := httptest.NewRequest(c.Method, "/api/v1/some-data", strings.NewReader(c.Body))
+	if c.Chunked {
+		r.ContentLength = -1
+	}
+	rw := httptest.NewRecorder()
+	b.ServeHTTP(rw, r)
+	require.Equal(t, c.Status, rw.Code, c.Name)
+	if c.Status == http.StatusOK && c.Method != http.MethodHead {
+		require.Equal(t, c.Method+" "+c.Body, rw.Body.String(), c.Name)
+	}
+}
+
+func TestBalancer_Retry(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rw.Write([]byte(r.Method + " " + string(body)))
+	}))
+	defer ok.Close()
+
+	// Connections to a closed server are refused.
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+
+	// The server closes connections without a response.
+	hangUp := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer hangUp.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	for _, c := range []RetryTestCase{
+		{Name: "get", Method: http.MethodGet, Status: http.StatusOK},
+		{Name: "head", Method: http.MethodHead, Status: http.StatusOK},
+		{Name: "put", Method: http.MethodPut, Body: "replayable", Status: http.StatusOK},
+		{Name: "delete", Method: http.MethodDelete, Status: http.StatusOK},
+		{
+			Name:         "post",
+			Method:       http.MethodPost,
+			Body:         "replayable",
+			Status:       http.StatusOK,
+			HangUpStatus: http.StatusServiceUnavailable,
+		},
+		{
+			Name:   "large body",
+			Method: http.MethodPost,
+			Body:   strings.Repeat("a", 1025),
+			Status: http.StatusServiceUnavailable,
+		},
+		{
+			Name:    "unknown body length",
+			Method:  http.MethodPut,
+			Body:    "data",
+			Chunked: true,
+			Status:  http.StatusServiceUnavailable,
+		},
+		{
+			Name:   "no retries",
+			Method: http.MethodGet,
+			Setup:  func(b *balancer) { b.retries = 0 },
+			Status: http.StatusServiceUnavailable,
+		},
+		{
+			Name:   "budget exhausted",
+			Method: http.MethodGet,
+			Setup:  func(b *balancer) { b.budget = newRetryBudget(0, 0) },
+			Status: http.StatusServiceUnavailable,
+		},
+	} {
+		c.test(t, backendAddr(refused), backendAddr(ok))
+		if c.HangUpStatus != 0 {
+			c.Status = c.HangUpStatus
+		}
+		c.test(t, backendAddr(hangUp), backendAddr(ok))
+	}
+
+	RetryTestCase{
+		Name:   "try timeout",
+		Method: http.MethodGet,
+		Setup:  func(b *balancer) { b.tryTimeout = 50 * time.Millisecond },
+		Status: http.StatusOK,
+	}.test(t, backendAddr(slow), backendAddr(ok))
+
+	// Retries stop when no servers are left to try.
+	RetryTestCase{
+		Name:   "all failed",
+		Method: http.MethodGet,
+		Setup:  func(b *balancer) { b.retries = 5 },
+		Status: http.StatusServiceUnavailable,
+	}.test(t, backendAddr(refused), backendAddr(hangUp))
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := newRetryBudget(0.5, 1)
+	var requests []func()
+	for i := 0; i < 4; i++ {
+		requests = append(requests, budget.request())
+	}
+
+	var retries []func()
+	for i := 0; i < 2; i++ {
+		done, ok := budget.retry()
+		require.True(t, ok)
+		retries = append(retries, done)
+	}
+	_, ok := budget.retry()
+	require.False(t, ok, "half of 4 requests can be retried")
+
+	retries[0]()
+	done, ok := budget.retry()
+	require.True(t, ok)
+	done()
+
+	for _, done := range requests {
+		done()
+	}
+	retries[1]()
+	done, ok = budget.retry()
+	require.True(t, ok, "the minimum is always allowed")
+	done()
+}
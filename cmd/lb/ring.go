@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ring is a consistent hash ring of servers. Every server is placed on the
+// ring vnodes times, and a client belongs to the first healthy server
+// clockwise from its hash, so a server going down moves only its own clients.
+type ring struct {
+	hashes []uint32
+	owners map[uint32]string
+}
+
+func newRing(vnodes int, servers []string) *ring {
+	r := &ring{owners: make(map[uint32]string, vnodes*len(servers))}
+	for _, server := range servers {
+		for i := 0; i < vnodes; i++ {
+			h := crc32.ChecksumIEEE([]byte(server + "#" + strconv.Itoa(i)))
+			if _, ok := r.owners[h]; ok {
+				continue
+			}
+			r.owners[h] = server
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+// server returns the first server clockwise from the sum for which healthy
+// is true, or empty string if there is no such server.
+func (r *ring) server(sum uint32, healthy func(server string) bool) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	// Client hashes are mixed because addresses of clients are often close.
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], sum)
+	h := crc32.ChecksumIEEE(b[:])
+
+	start := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	for i := 0; i < len(r.hashes); i++ {
+		owner := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if healthy(owner) {
+			return owner
+		}
+	}
+	return ""
+}
+
+// consistentHash sends the same client to the same server. When a server
+// becomes unhealthy, only its clients are moved to other servers.
+type consistentHash struct {
+	vnodes int
+
+	mu      sync.Mutex
+	servers string
+	ring    *ring
+}
+
+func newConsistentHash(vnodes int) *consistentHash {
+	return &consistentHash{vnodes: vnodes}
+}
+
+func (c *consistentHash) Choose(sum uint32, pool []Server) (string, error) {
+	names := make([]string, len(pool))
+	healthyNames := make(map[string]bool, len(pool))
+	for i, server := range pool {
+		names[i] = server.name
+		if server.isHealthy {
+			healthyNames[server.name] = true
+		}
+	}
+
+	server := c.ringOf(names).server(sum, func(server string) bool {
+		return healthyNames[server]
+	})
+	if server == "" {
+		return "", errNoHealthyServers
+	}
+	return server, nil
+}
+
+func (c *consistentHash) Done(string, time.Duration) {}
+
+// ringOf returns the ring of the servers, which is rebuilt only when they change.
+func (c *consistentHash) ringOf(names []string) *ring {
+	key := strings.Join(names, ",")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ring == nil || c.servers != key {
+		c.ring = newRing(c.vnodes, names)
+		c.servers = key
+	}
+	return c.ring
+}
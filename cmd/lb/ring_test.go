@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// assign returns servers chosen by the ring for every client.
+func assign(t *testing.T, s Strategy, pool []Server, clients int) []string {
+	res := make([]string, clients)
+	for i := range res {
+		server, err := s.Choose(uint32(i)*2654435761, pool)
+		require.NoError(t, err)
+		res[i] = server
+	}
+	return res
+}
+
+func TestConsistentHash(t *testing.T) {
+	const clients = 10000
+	s := newConsistentHash(100)
+	pool := []Server{
+		{name: "server1:8080", isHealthy: true},
+		{name: "server2:8080", isHealthy: true},
+		{name: "server3:8080", isHealthy: true},
+		{name: "server4:8080", isHealthy: true},
+	}
+	before := assign(t, s, pool, clients)
+
+	counts := make(map[string]int)
+	for _, server := range before {
+		counts[server]++
+	}
+	for _, server := range pool {
+		require.Greater(t, counts[server.name], clients/8, server.name)
+	}
+
+	t.Run("unhealthy server", func(t *testing.T) {
+		pool[1].isHealthy = false
+		defer func() { pool[1].isHealthy = true }()
+
+		moved := 0
+		for i, server := range assign(t, s, pool, clients) {
+			if server != before[i] {
+				require.Equal(t, "server2:8080", before[i], "client of a healthy server moved")
+				moved++
+			}
+		}
+		require.Equal(t, counts["server2:8080"], moved)
+
+		// Clients return when the server is healthy again.
+		pool[1].isHealthy = true
+		require.Equal(t, before, assign(t, s, pool, clients))
+	})
+
+	t.Run("new server", func(t *testing.T) {
+		bigger := append(append([]Server(nil), pool...), Server{name: "server5:8080", isHealthy: true})
+		moved := 0
+		for i, server := range assign(t, s, bigger, clients) {
+			if server != before[i] {
+				require.Equal(t, "server5:8080", server, "client moved between old servers")
+				moved++
+			}
+		}
+		// About a fifth of clients move to the new server.
+		require.InDelta(t, clients/5, moved, clients/10)
+	})
+}
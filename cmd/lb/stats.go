@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// serverStats is the state of a server shown by the stats endpoint.
+type serverStats struct {
+	Name      string `json:"name"`
+	Healthy   bool   `json:"healthy"`
+	Weight    int    `json:"weight"`
+	Ejected   bool   `json:"ejected"`
+	Ejections int    `json:"ejections"`
+	// EjectedUntil is the end of the last ejection.
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+	// Failures is the number of requests failed in a row.
+	Failures int `json:"failures"`
+}
+
+// statsHandler serves the state of servers of the pool as JSON.
+func statsHandler(pool *Pool, outliers *outliers) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		servers := pool.Servers()
+		stats := make([]serverStats, len(servers))
+		for i, server := range servers {
+			state, ejected := outliers.state(server.name)
+			stats[i] = serverStats{
+				Name:      server.name,
+				Healthy:   server.isHealthy,
+				Weight:    server.effectiveWeight(),
+				Ejected:   ejected,
+				Ejections: state.ejections,
+				Failures:  state.failures,
+			}
+			if !state.ejectedUntil.IsZero() {
+				until := state.ejectedUntil
+				stats[i].EjectedUntil = &until
+			}
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(rw).Encode(stats); err != nil {
+			log.Printf("Failed to write response: %s", err)
+		}
+	})
+}
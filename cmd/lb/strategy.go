@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNoHealthyServers = errors.New("no healthy servers")
+
+// Strategy chooses a backend for every request.
+type Strategy interface {
+	// Choose returns the name of a healthy server from the pool for the
+	// client with the hash sum.
+	Choose(sum uint32, pool []Server) (string, error)
+	// Done is called when the request forwarded to the server is finished.
+	Done(server string, latency time.Duration)
+}
+
+var strategies = map[string]func() Strategy{
+	"ip-hash":              func() Strategy { return newConsistentHash(*vnodes) },
+	"round-robin":          func() Strategy { return new(roundRobin) },
+	"least-connections":    func() Strategy { return &leastConnections{newConnections()} },
+	"weighted-round-robin": func() Strategy { return newWeightedRoundRobin() },
+	"power-of-two":         func() Strategy { return newPowerOfTwo(time.Now().UnixNano()) },
+	"least-latency":        func() Strategy { return newLeastLatency(0.3) },
+}
+
+func newStrategy(name string) (Strategy, error) {
+	create, ok := strategies[name]
+	if !ok {
+		names := make([]string, 0, len(strategies))
+		for n := range strategies {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown strategy %s, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return create(), nil
+}
+
+func healthy(pool []Server) []Server {
+	var servers []Server
+	for _, server := range pool {
+		if server.isHealthy {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// roundRobin sends requests to healthy servers in turn.
+type roundRobin struct {
+	next uint32
+}
+
+func (rr *roundRobin) Choose(_ uint32, pool []Server) (string, error) {
+	servers := healthy(pool)
+	if len(servers) == 0 {
+		return "", errNoHealthyServers
+	}
+	n := atomic.AddUint32(&rr.next, 1) - 1
+	return servers[n%uint32(len(servers))].name, nil
+}
+
+func (rr *roundRobin) Done(string, time.Duration) {}
+
+// connections counts requests in flight per server.
+type connections struct {
+	sync.Mutex
+	active map[string]int
+}
+
+func newConnections() *connections {
+	return &connections{active: make(map[string]int)}
+}
+
+func (c *connections) start(server string) {
+	c.active[server]++
+}
+
+func (c *connections) Done(server string, _ time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if c.active[server] > 1 {
+		c.active[server]--
+	} else {
+		delete(c.active, server)
+	}
+}
+
+// leastConnections sends requests to the server with the fewest requests in flight.
+type leastConnections struct {
+	*connections
+}
+
+func (lc *leastConnections) Choose(_ uint32, pool []Server) (string, error) {
+	servers := healthy(pool)
+	if len(servers) == 0 {
+		return "", errNoHealthyServers
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+	best := servers[0].name
+	for _, server := range servers[1:] {
+		if lc.active[server.name] < lc.active[best] {
+			best = server.name
+		}
+	}
+	lc.start(best)
+	return best, nil
+}
+
+// weightedRoundRobin is the smooth weighted round-robin: a server with
+// weight 3 gets 3 of every 4 requests when the other one has weight 1, and
+// the requests are interleaved.
+type weightedRoundRobin struct {
+	sync.Mutex
+	current map[string]int
+}
+
+func newWeightedRoundRobin() *weightedRoundRobin {
+	return &weightedRoundRobin{current: make(map[string]int)}
+}
+
+func (w *weightedRoundRobin) Choose(_ uint32, pool []Server) (string, error) {
+	servers := healthy(pool)
+	if len(servers) == 0 {
+		return "", errNoHealthyServers
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	total := 0
+	best := ""
+	for _, server := range servers {
+		w.current[server.name] += server.effectiveWeight()
+		total += server.effectiveWeight()
+		if best == "" || w.current[server.name] > w.current[best] {
+			best = server.name
+		}
+	}
+	w.current[best] -= total
+	return best, nil
+}
+
+func (w *weightedRoundRobin) Done(string, time.Duration) {}
+
+// powerOfTwo picks two random healthy servers and sends the request to the
+// one with fewer requests in flight.
+type powerOfTwo struct {
+	*connections
+	rand *rand.Rand
+}
+
+func newPowerOfTwo(seed int64) *powerOfTwo {
+	return &powerOfTwo{
+		connections: newConnections(),
+		rand:        rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (p *powerOfTwo) Choose(_ uint32, pool []Server) (string, error) {
+	servers := healthy(pool)
+	if len(servers) == 0 {
+		return "", errNoHealthyServers
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	best := servers[p.rand.Intn(len(servers))].name
+	if len(servers) > 1 {
+		i := p.rand.Intn(len(servers) - 1)
+		if servers[i].name == best {
+			i = len(servers) - 1
+		}
+		if other := servers[i].name; p.active[other] < p.active[best] {
+			best = other
+		}
+	}
+	p.start(best)
+	return best, nil
+}
+
+// leastLatency sends requests to the server with the lowest exponentially
+// weighted moving average of response time multiplied by the number of its
+// requests in flight. Servers without responses yet are tried first.
+type leastLatency struct {
+	*connections
+	// alpha is the weight of the latest response time in the average.
+	alpha   float64
+	average map[string]float64
+}
+
+func newLeastLatency(alpha float64) *leastLatency {
+	return &leastLatency{
+		connections: newConnections(),
+		alpha:       alpha,
+		average:     make(map[string]float64),
+	}
+}
+
+func (l *leastLatency) Choose(_ uint32, pool []Server) (string, error) {
+	servers := healthy(pool)
+	if len(servers) == 0 {
+		return "", errNoHealthyServers
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	best, bestScore := "", 0.0
+	for _, server := range servers {
+		// One nanosecond keeps servers without responses apart by their requests in flight.
+		score := (l.average[server.name] + 1) * float64(l.active[server.name]+1)
+		if best == "" || score < bestScore {
+			best, bestScore = server.name, score
+		}
+	}
+	l.start(best)
+	return best, nil
+}
+
+func (l *leastLatency) Done(server string, latency time.Duration) {
+	l.connections.Done(server, latency)
+
+	l.Lock()
+	defer l.Unlock()
+	if avg, ok := l.average[server]; ok {
+		l.average[server] = l.alpha*float64(latency) + (1-l.alpha)*avg
+	} else {
+		l.average[server] = float64(latency)
+	}
+}
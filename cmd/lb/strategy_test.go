@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testPool() []Server {
+	return []Server{
+		{name: "server1", isHealthy: true},
+		{name: "server2", isHealthy: true},
+		{name: "server3", isHealthy: true},
+	}
+}
+
+func choose(t *testing.T, s Strategy, pool []Server, n int) []string {
+	var chosen []string
+	for i := 0; i < n; i++ {
+		server, err := s.Choose(0, pool)
+		require.NoError(t, err)
+		chosen = append(chosen, server)
+	}
+	return chosen
+}
+
+func TestNewStrategy(t *testing.T) {
+	_, err := newStrategy("random")
+	require.Error(t, err)
+}
+
+func TestRoundRobin(t *testing.T) {
+	pool := testPool()
+	pool[1].isHealthy = false
+	require.Equal(t, []string{"server1", "server3", "server1", "server3"}, choose(t, new(roundRobin), pool, 4))
+}
+
+func TestLeastConnections(t *testing.T) {
+	s := &leastConnections{newConnections()}
+	pool := testPool()
+	require.Equal(t, []string{"server1", "server2", "server3", "server1"}, choose(t, s, pool, 4))
+
+	s.Done("server2", time.Millisecond)
+	require.Equal(t, []string{"server2"}, choose(t, s, pool, 1))
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	pool := testPool()
+	pool[0].weight = 3
+	pool[2].isHealthy = false
+
+	chosen := choose(t, newWeightedRoundRobin(), pool, 8)
+	require.Equal(t, []string{"server1", "server1", "server2", "server1"}, chosen[:4])
+	require.Equal(t, chosen[:4], chosen[4:])
+}
+
+func TestPowerOfTwo(t *testing.T) {
+	s := newPowerOfTwo(1)
+	pool := testPool()
+
+	counts := make(map[string]int)
+	for _, server := range choose(t, s, pool, 30) {
+		counts[server]++
+	}
+	// Without finished requests the load is spread almost evenly.
+	for _, server := range pool {
+		require.InDelta(t, 10, counts[server.name], 1, server.name)
+	}
+
+	pool[0].isHealthy = false
+	pool[1].isHealthy = false
+	require.Equal(t, []string{"server3"}, choose(t, s, pool, 1))
+}
+
+func TestLeastLatency(t *testing.T) {
+	s := newLeastLatency(0.5)
+	pool := testPool()
+
+	// Servers without responses are tried first.
+	require.Equal(t, []string{"server1", "server2", "server3"}, choose(t, s, pool, 3))
+	s.Done("server1", 100*time.Millisecond)
+	s.Done("server2", 10*time.Millisecond)
+	s.Done("server3", 50*time.Millisecond)
+	require.Equal(t, []string{"server2"}, choose(t, s, pool, 1))
+	s.Done("server2", 10*time.Millisecond)
+
+	// The average follows latency changes.
+	s.Done("server2", 200*time.Millisecond)
+	s.Done("server2", 200*time.Millisecond)
+	require.Equal(t, []string{"server3"}, choose(t, s, pool, 1))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// timeouts of forwarding a request, zero means no timeout.
+type timeouts struct {
+	// connect limits connecting to a backend.
+	connect time.Duration
+	// responseHeader limits waiting for the response headers of a try,
+	// sending the request included.
+	responseHeader time.Duration
+	// total limits the whole request including retries and the response body.
+	// Upgraded connections and event streams are only limited until their
+	// response headers arrive.
+	total time.Duration
+}
+
+// routeTimeout overrides timeouts set in it for paths starting with prefix.
+type routeTimeout struct {
+	prefix                         string
+	connect, responseHeader, total *time.Duration
+}
+
+// routeTimeouts is a flag.Value of timeouts for path prefixes, e.g.
+// /upload:total=5m,header=30s. The prefix ends with the first colon and
+// timeouts are named connect, header and total.
+type routeTimeouts []routeTimeout
+
+func (rt *routeTimeouts) String() string {
+	if rt == nil {
+		return ""
+	}
+	var routes []string
+	for _, r := range *rt {
+		var values []string
+		for _, v := range []struct {
+			name string
+			d    *time.Duration
+		}{{"connect", r.connect}, {"header", r.responseHeader}, {"total", r.total}} {
+			if v.d != nil {
+				values = append(values, v.name+"="+v.d.String())
+			}
+		}
+		routes = append(routes, r.prefix+":"+strings.Join(values, ","))
+	}
+	return strings.Join(routes, " ")
+}
+
+func (rt *routeTimeouts) Set(value string) error {
+	i := strings.IndexByte(value, ':')
+	if i == -1 || !strings.HasPrefix(value, "/") {
+		return fmt.Errorf("route timeout %q must look like /prefix:total=10s", value)
+	}
+	r := routeTimeout{prefix: value[:i]}
+	for _, item := range strings.Split(value[i+1:], ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid timeout %q", item)
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("negative timeout %q", item)
+		}
+		switch kv[0] {
+		case "connect":
+			r.connect = &d
+		case "header":
+			r.responseHeader = &d
+		case "total":
+			r.total = &d
+		default:
+			return fmt.Errorf("unknown timeout %s, expected connect, header or total", kv[0])
+		}
+	}
+	*rt = append(*rt, r)
+	return nil
+}
+
+// forPath returns def overridden by the route with the longest prefix of path.
+func (rt routeTimeouts) forPath(def timeouts, path string) timeouts {
+	var match *routeTimeout
+	for i := range rt {
+		r := &rt[i]
+		if strings.HasPrefix(path, r.prefix) && (match == nil || len(r.prefix) > len(match.prefix)) {
+			match = r
+		}
+	}
+	if match == nil {
+		return def
+	}
+	if match.connect != nil {
+		def.connect = *match.connect
+	}
+	if match.responseHeader != nil {
+		def.responseHeader = *match.responseHeader
+	}
+	if match.total != nil {
+		def.total = *match.total
+	}
+	return def
+}
+
+type totalTimerKey struct{}
+
+// withTotalTimeout returns the context canceled after d, unless the timeout is
+// stopped by stopTotalTimeout before.
+func withTotalTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(d, cancel)
+	return context.WithValue(ctx, totalTimerKey{}, timer), func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
+// stopTotalTimeout stops the total timeout of the context if it has not
+// expired yet.
+func stopTotalTimeout(ctx context.Context) {
+	if timer, ok := ctx.Value(totalTimerKey{}).(*time.Timer); ok {
+		timer.Stop()
+	}
+}
+
+// longLived reports whether the response lasts as long as the client and the
+// backend want, which is the case for upgraded connections and event streams.
+func longLived(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("content-type"))
+	return mediaType == "text/event-stream"
+}
+
+type connectTimeoutKey struct{}
+
+// withConnectTimeout returns the context limiting connecting to backends by d.
+func withConnectTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, connectTimeoutKey{}, d)
+}
+
+var dialer = &net.Dialer{KeepAlive: 30 * time.Second}
+
+// dialContext connects to a backend within the connect timeout of the request.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok && d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+type responseHeaderTimeoutKey struct{}
+
+// withResponseHeaderTimeout returns the context limiting waiting for response
+// headers of backends by d.
+func withResponseHeaderTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, responseHeaderTimeoutKey{}, d)
+}
+
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// timeoutTransport cancels requests if the response headers do not arrive
+// within the response header timeout of the request.
+type timeoutTransport struct {
+	next http.RoundTripper
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout, _ := req.Context().Value(responseHeaderTimeoutKey{}).(time.Duration)
+	if timeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The timer fired, even if the response was received right before.
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// Bodies of upgraded connections are written to as well.
+	if body, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &cancelReadWriteBody{ReadWriteCloser: body, cancel: cancel}
+	} else {
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	}
+	return resp, nil
+}
+
+// cancelBody releases the context of the request when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+type cancelReadWriteBody struct {
+	io.ReadWriteCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelReadWriteBody) Close() error {
+	err := b.ReadWriteCloser.Close()
+	b.cancel()
+	return err
+}
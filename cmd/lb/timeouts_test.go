@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	var routes routeTimeouts
+	require.NoError(t, routes.Set("/api:header=2s"))
+	require.NoError(t, routes.Set("/api/upload:connect=1s,total=5m"))
+	require.NoError(t, routes.Set("/events:total=0s"))
+	require.Equal(t, "/api:header=2s /api/upload:connect=1s,total=5m0s /events:total=0s", routes.String())
+
+	for _, value := range []string{"api:total=1s", "/api", "/api:total", "/api:total=x", "/api:total=-1s", "/api:body=1s"} {
+		require.Error(t, new(routeTimeouts).Set(value), value)
+	}
+
+	def := timeouts{connect: time.Second, responseHeader: 3 * time.Second, total: 10 * time.Second}
+	for path, expected := range map[string]timeouts{
+		"/":                 def,
+		"/ap":               def,
+		"/api/users":        {connect: time.Second, responseHeader: 2 * time.Second, total: 10 * time.Second},
+		"/api/upload/image": {connect: time.Second, responseHeader: 3 * time.Second, total: 5 * time.Minute},
+		"/events":           {connect: time.Second, responseHeader: 3 * time.Second},
+	} {
+		require.Equal(t, expected, routes.forPath(def, path), path)
+	}
+}
+
+func TestBalancer_Timeouts(t *testing.T) {
+	// The backend sends headers after 500ms and the body after 500ms more.
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		time.Sleep(500 * time.Millisecond)
+		rw.Write([]byte("done"))
+	}))
+	defer slow.Close()
+
+	var routes routeTimeouts
+	require.NoError(t, routes.Set("/slow:header=2s"))
+	require.NoError(t, routes.Set("/slow/long:header=2s,total=5s"))
+
+	for path, expected := range map[string]string{
+		"/other":     "",
+		"/slow":      "",
+		"/slow/long": "done",
+	} {
+		b := newTestBalancer(t, backendAddr(slow))
+		b.retries = 0
+		b.timeouts = timeouts{connect: time.Second, responseHeader: 100 * time.Millisecond, total: 750 * time.Millisecond}
+		b.routes = routes
+
+		rw := httptest.NewRecorder()
+		b.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		if path == "/other" {
+			require.Equal(t, http.StatusServiceUnavailable, rw.Code, "headers must time out")
+			continue
+		}
+		require.Equal(t, http.StatusOK, rw.Code, path)
+		// The total timeout cuts the body of /slow.
+		require.Equal(t, expected, rw.Body.String(), path)
+	}
+}
@@ -1,29 +1,60 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
-	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/dbclient"
 	"github.com/OlegVanyaGreatBand/kpi-lab-2/httptools"
 	"github.com/OlegVanyaGreatBand/kpi-lab-2/signal"
 )
 
 var port = flag.Int("port", 8080, "server port")
-var db = flag.String("db", "http://database:8070/db/", "database url")
+var db = flag.String("db", "http://database:8070", "database url")
+var dbToken = flag.String("db-token", "", "bearer token for the database")
+var tlsCert = flag.String("tls-cert", "", "certificate file to serve HTTPS with")
+var tlsKey = flag.String("tls-key", "", "private key file of the HTTPS certificate")
+var tlsClientCA = flag.String("tls-client-ca", "", "CA file to verify client certificates with (mutual TLS)")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "time to wait for in-flight requests on shutdown")
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
+type keyValue struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+type keyValues struct {
+	Values  []keyValue `json:"values"`
+	Missing []string   `json:"missing"`
+}
+
+func multiResponse(keys []string, values map[string]interface{}) keyValues {
+	res := keyValues{
+		Values:  make([]keyValue, 0, len(values)),
+		Missing: make([]string, 0),
+	}
+	for _, k := range keys {
+		if v, ok := values[k]; ok {
+			res.Values = append(res.Values, keyValue{Key: k, Value: v})
+		} else {
+			res.Missing = append(res.Missing, k)
+		}
+	}
+	return res
+}
+
 func main() {
 	flag.Parse()
 	h := new(http.ServeMux)
+	dbClient := dbclient.New(*db, dbclient.WithToken(*dbToken))
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "text/plain")
@@ -46,63 +77,58 @@ func main() {
 
 		report.Process(r)
 
-		k, ok := r.URL.Query()["key"]
+		keys, ok := r.URL.Query()["key"]
 		rw.Header().Set("content-type", "application/json")
 
-		if !ok || len(k[0]) < 1 {
+		if !ok || len(keys[0]) < 1 {
 			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		v, err := http.Get(*db + k[0])
+		values, err := dbClient.GetMany(r.Context(), keys)
 		if err != nil {
 			log.Printf("Failed to get data from db: %s", err)
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		defer v.Body.Close()
 
-		if v.StatusCode != http.StatusOK {
-			if v.StatusCode == http.StatusNotFound {
+		var res interface{}
+		if len(keys) == 1 {
+			v, found := values[keys[0]]
+			if !found {
 				rw.WriteHeader(http.StatusNotFound)
-			} else {
-				rw.WriteHeader(http.StatusInternalServerError)
+				return
 			}
-
-			return
-		}
-
-		b, err := ioutil.ReadAll(v.Body)
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			log.Printf("Failed to read response body: %s", err)
-			return
+			res = keyValue{Key: keys[0], Value: v}
+		} else {
+			// Several keys are requested with ?key=a&key=b.
+			res = multiResponse(keys, values)
 		}
 
 		rw.WriteHeader(http.StatusOK)
-		if _, err = rw.Write(b); err != nil {
+		if err := json.NewEncoder(rw).Encode(res); err != nil {
 			log.Printf("Failed to write response body: %s", err)
 		}
 	})
 
 	h.Handle("/report", report)
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, h,
+		httptools.WithTLS(*tlsCert, *tlsKey),
+		httptools.WithClientCA(*tlsClientCA))
 	t := time.Now().Format("2006-01-02")
-	body := []byte(fmt.Sprintf(`{"value": "%s"}`, t))
-	r, err := http.Post(
-		*db + "ovgb",
-		"application/json",
-		bytes.NewBuffer(body))
-	if err != nil {
+	if err := dbClient.Put(context.Background(), "ovgb", t); err != nil {
 		log.Printf("Failed to upload current time to database: %s", err)
+	} else {
+		log.Print("Current date uploaded")
 	}
 
-	if r.StatusCode != http.StatusOK {
-		log.Printf("Failed to upload current time to database: %s", r.Status)
-	}
-
-	log.Print("Current date uploaded")
 	server.Start()
-	signal.WaitForTerminationSignal()
+	<-signal.TerminationContext().Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down the server: %s", err)
+	}
 }
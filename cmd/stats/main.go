@@ -7,15 +7,15 @@ import (
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/OlegVanyaGreatBand/kpi-lab-2/lbconfig"
 )
 
 var https = flag.Bool("https", false, "whether backends support HTTPs")
-
-var serversPool = []string{
-	"localhost:8080",
-	"localhost:8081",
-	"localhost:8082",
-}
+var configPath = flag.String("config", "", "backends config file of the load balancer; overrides -backends")
+var backends = flag.String("backends", "localhost:8080,localhost:8081,localhost:8082", "comma separated backend addresses")
+var balancer = flag.String("lb", "localhost:8090", "load balancer address to show the state of backends from (empty disables)")
+var balancerStatsPath = flag.String("lb-stats-path", "/lb/stats", "stats path of the load balancer")
 
 type report map[string][]string
 
@@ -29,6 +29,21 @@ func scheme() string {
 func main()  {
 	flag.Parse()
 
+	var conf *lbconfig.Config
+	var err error
+	if *configPath != "" {
+		conf, err = lbconfig.Load(*configPath)
+	} else {
+		conf, err = lbconfig.FromList(*backends, lbconfig.HealthCheck{})
+	}
+	if err != nil {
+		log.Fatalf("Failed to load backends: %s", err)
+	}
+	serversPool := make([]string, len(conf.Backends))
+	for i, b := range conf.Backends {
+		serversPool[i] = b.Address
+	}
+
 	client := new(http.Client)
 	client.Timeout = 10 * time.Second
 
@@ -59,4 +74,24 @@ func main()  {
 		data, _ := json.MarshalIndent(res[i], "", "  ")
 		log.Println(string(data))
 	}
+
+	if *balancer != "" {
+		resp, err := client.Get(fmt.Sprintf("%s://%s%s", scheme(), *balancer, *balancerStatsPath))
+		if err != nil {
+			log.Printf("error %s %s", *balancer, err)
+			return
+		}
+		defer resp.Body.Close()
+		var data []map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+			log.Printf("error parsing from %s: %s", *balancer, err)
+			return
+		}
+
+		log.Println("=========================")
+		log.Println("BALANCER", *balancer)
+		log.Println("=========================")
+		out, _ := json.MarshalIndent(data, "", "  ")
+		log.Println(string(out))
+	}
 }
@@ -0,0 +1,315 @@
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("record does not exist")
+	ErrWrongType = errors.New("wrong value type")
+)
+
+// StatusError is returned when the db server responds with an unexpected status.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("db server responded with %s", e.Status)
+}
+
+// Client is a client of the db server HTTP API.
+// Failed requests are retried on network errors and 5xx responses.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+	token      string
+}
+
+// Option configures the Client.
+type Option func(c *Client)
+
+// WithHTTPClient sets the HTTP client used for requests.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = client
+	}
+}
+
+// WithTimeout sets the timeout of a single request attempt.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries sets how many times a failed request is retried and the delay
+// before the first retry, which grows linearly with every attempt.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithToken sets the bearer token sent with every request.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New creates a client of the db server at baseURL, e.g. http://database:8070.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    baseURL,
+		httpClient: http.DefaultClient,
+		timeout:    3 * time.Second,
+		retries:    2,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type valueResponse struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Get returns the string value of the key.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	raw, err := c.get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	var v string
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", ErrWrongType
+	}
+	return v, nil
+}
+
+// GetInt64 returns the int64 value of the key.
+func (c *Client) GetInt64(ctx context.Context, key string) (int64, error) {
+	raw, err := c.get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	var v int64
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return 0, ErrWrongType
+	}
+	return v, nil
+}
+
+// GetMany returns values of the keys with a single request. Values are
+// string, int64 or []byte, missing keys are not included in the result.
+func (c *Client) GetMany(ctx context.Context, keys []string) (map[string]interface{}, error) {
+	body, err := json.Marshal(struct {
+		Keys []string `json:"keys"`
+	}{keys})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "_mget", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Values []valueResponse `json:"values"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{}, len(res.Values))
+	for _, v := range res.Values {
+		value, err := v.decode()
+		if err != nil {
+			return nil, err
+		}
+		values[v.Key] = value
+	}
+	return values, nil
+}
+
+// Put sets the string value of the key.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.put(ctx, key, value)
+}
+
+// PutInt64 sets the int64 value of the key.
+func (c *Client) PutInt64(ctx context.Context, key string, value int64) error {
+	return c.put(ctx, key, value)
+}
+
+// Delete removes the key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// decode returns the value as string, int64 or []byte depending on its type.
+func (v valueResponse) decode() (interface{}, error) {
+	switch v.Type {
+	case "int64":
+		var i int64
+		err := json.Unmarshal(v.Value, &i)
+		return i, err
+	case "bytes":
+		var b []byte
+		err := json.Unmarshal(v.Value, &b)
+		return b, err
+	case "string":
+		var s string
+		err := json.Unmarshal(v.Value, &s)
+		return s, err
+	default:
+		return nil, fmt.Errorf("unknown value type %q", v.Type)
+	}
+}
+
+func (c *Client) get(ctx context.Context, key string) (json.RawMessage, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res valueResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	// Bytes values are base64 strings in JSON.
+	if res.Type == "bytes" {
+		return nil, ErrWrongType
+	}
+	return res.Value, nil
+}
+
+func (c *Client) put(ctx context.Context, key string, value interface{}) error {
+	body, err := json.Marshal(struct {
+		Value interface{} `json:"value"`
+	}{value})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, key, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends the request to /db/<key>, retrying it if needed, and returns the
+// response if its status is 200 OK.
+func (c *Client) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	u := c.baseURL + "/db/" + url.PathEscape(key)
+
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * c.backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		var resp *http.Response
+		resp, err = c.attempt(ctx, method, u, body)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+		case resp.StatusCode == http.StatusNotFound:
+			resp.Body.Close()
+			return nil, ErrNotFound
+		case resp.StatusCode >= 500:
+			resp.Body.Close()
+			err = &StatusError{Code: resp.StatusCode, Status: resp.Status}
+			continue
+		default:
+			resp.Body.Close()
+			return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+		}
+	}
+
+	return nil, err
+}
+
+func (c *Client) attempt(ctx context.Context, method, u string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	req, err := http.NewRequestWithContext(attemptCtx, method, u, reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The attempt context must live until the body is read.
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	_, _ = io.Copy(ioutil.Discard, b.ReadCloser)
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
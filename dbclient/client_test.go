@@ -0,0 +1,206 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	var failures int32
+	values := map[string]json.RawMessage{
+		"str":   json.RawMessage(`"value"`),
+		"num":   json.RawMessage(`42`),
+		"a b/c": json.RawMessage(`"escaped"`),
+		"bin":   json.RawMessage(`"AP8="`),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		k := r.URL.Path[len("/db/"):]
+		if k == "_mget" {
+			var req struct {
+				Keys []string `json:"keys"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var res struct {
+				Values []valueResponse `json:"values"`
+			}
+			for _, k := range req.Keys {
+				if v, ok := values[k]; ok {
+					res.Values = append(res.Values, valueResponse{Key: k, Type: valueType(k, v), Value: v})
+				}
+			}
+			_ = json.NewEncoder(rw).Encode(res)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			v, ok := values[k]
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(rw).Encode(valueResponse{Key: k, Type: valueType(k, v), Value: v})
+		case http.MethodPost:
+			var body struct {
+				Value json.RawMessage `json:"value"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			values[k] = body.Value
+		case http.MethodDelete:
+			if _, ok := values[k]; !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(values, k)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c := New(server.URL, WithRetries(2, time.Millisecond))
+
+	t.Run("get", func(t *testing.T) {
+		if v, err := c.Get(ctx, "str"); err != nil || v != "value" {
+			t.Errorf("Bad value returned: %s, %v", v, err)
+		}
+		if v, err := c.GetInt64(ctx, "num"); err != nil || v != 42 {
+			t.Errorf("Bad value returned: %d, %v", v, err)
+		}
+		if v, err := c.Get(ctx, "a b/c"); err != nil || v != "escaped" {
+			t.Errorf("Bad value returned: %s, %v", v, err)
+		}
+		if _, err := c.Get(ctx, "num"); err != ErrWrongType {
+			t.Errorf("Expected ErrWrongType, got %v", err)
+		}
+		if _, err := c.Get(ctx, "bin"); err != ErrWrongType {
+			t.Errorf("Expected ErrWrongType for bytes, got %v", err)
+		}
+		if _, err := c.GetInt64(ctx, "missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("get many", func(t *testing.T) {
+		values, err := c.GetMany(ctx, []string{"str", "num", "bin", "missing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{
+			"str": "value",
+			"num": int64(42),
+			"bin": []byte{0, 0xff},
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("Unexpected values %v, expected %v", values, expected)
+		}
+	})
+
+	t.Run("put", func(t *testing.T) {
+		if err := c.Put(ctx, "quote", `say "hi"`); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := c.Get(ctx, "quote"); err != nil || v != `say "hi"` {
+			t.Errorf("Bad value returned: %s, %v", v, err)
+		}
+		if err := c.PutInt64(ctx, "num", -1); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := c.GetInt64(ctx, "num"); err != nil || v != -1 {
+			t.Errorf("Bad value returned: %d, %v", v, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := c.Delete(ctx, "quote"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Delete(ctx, "quote"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		atomic.StoreInt32(&failures, 2)
+		if v, err := c.Get(ctx, "str"); err != nil || v != "value" {
+			t.Errorf("Request was not retried: %s, %v", v, err)
+		}
+
+		atomic.StoreInt32(&failures, 3)
+		_, err := c.Get(ctx, "str")
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.Code != http.StatusInternalServerError {
+			t.Errorf("Expected StatusError after retries, got %v", err)
+		}
+		atomic.StoreInt32(&failures, 0)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}))
+		defer slow.Close()
+
+		c := New(slow.URL, WithTimeout(10*time.Millisecond), WithRetries(1, time.Millisecond))
+		start := time.Now()
+		if _, err := c.Get(ctx, "str"); err == nil {
+			t.Error("Expected timeout error")
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Errorf("Request was not timed out: %s", time.Since(start))
+		}
+	})
+
+	t.Run("token", func(t *testing.T) {
+		secured := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("authorization") != "Bearer secret" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(rw).Encode(valueResponse{Key: "str", Type: "string", Value: values["str"]})
+		}))
+		defer secured.Close()
+
+		var statusErr *StatusError
+		if _, err := New(secured.URL).Get(ctx, "str"); !errors.As(err, &statusErr) || statusErr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 without token, got %v", err)
+		}
+		if v, err := New(secured.URL, WithToken("secret")).Get(ctx, "str"); err != nil || v != "value" {
+			t.Errorf("Bad value returned: %s, %v", v, err)
+		}
+	})
+}
+
+// valueType guesses the type of the value stored by the test server.
+func valueType(k string, v json.RawMessage) string {
+	if k == "bin" {
+		return "bytes"
+	}
+	if v[0] == '"' {
+		return "string"
+	}
+	return "int64"
+}
@@ -1,30 +1,120 @@
 package httptools
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"time"
 )
 
 type Server interface {
 	Start()
+	// Shutdown stops accepting connections and waits until in-flight requests
+	// are finished or ctx is done.
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
 	httpServer *http.Server
+	certFile   string
+	keyFile    string
+	clientCA   string
 }
 
 func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		l, err := net.Listen("tcp", s.httpServer.Addr)
+		if err == nil {
+			err = s.serve(l)
+		}
+		if err == http.ErrServerClosed {
+			log.Println("HTTP server is shut down")
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
-func CreateServer(port int, handler http.Handler) Server {
-	return server{
+func (s server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// serve accepts connections on the listener, using TLS if it is configured.
+func (s server) serve(l net.Listener) error {
+	if s.certFile == "" {
+		if s.clientCA != "" {
+			l.Close()
+			return errors.New("client CA requires TLS certificate")
+		}
+		return s.httpServer.Serve(l)
+	}
+
+	config, err := s.tlsConfig()
+	if err != nil {
+		l.Close()
+		return err
+	}
+	s.httpServer.TLSConfig = config
+	return s.httpServer.ServeTLS(l, s.certFile, s.keyFile)
+}
+
+func (s server) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.clientCA == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(s.clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", s.clientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// Option configures the server created by CreateServer.
+type Option func(s *server)
+
+// WithWriteTimeout overrides the default response write timeout.
+// Zero means no timeout, which is needed for long-lived streaming responses.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(s *server) {
+		s.httpServer.WriteTimeout = timeout
+	}
+}
+
+// WithTLS makes the server serve HTTPS with the PEM encoded certificate and
+// key files. Empty certFile leaves the server on plain HTTP.
+func WithTLS(certFile, keyFile string) Option {
+	return func(s *server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+// WithClientCA makes the server require client certificates signed by the
+// PEM encoded CA certificates from caFile (mutual TLS). It needs WithTLS.
+// Empty caFile does not require client certificates.
+func WithClientCA(caFile string) Option {
+	return func(s *server) {
+		s.clientCA = caFile
+	}
+}
+
+func CreateServer(port int, handler http.Handler, opts ...Option) Server {
+	s := server{
 		httpServer: &http.Server{
 			Addr:           fmt.Sprintf(":%d", port),
 			Handler:        handler,
@@ -33,4 +123,8 @@ func CreateServer(port int, handler http.Handler) Server {
 			MaxHeaderBytes: 1 << 20,
 		},
 	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return s
 }
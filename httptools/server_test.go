@@ -0,0 +1,218 @@
+package httptools
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate signed by the test CA, or the CA itself.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+func newTestCert(t *testing.T, dir, name string, ca *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(c.certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// startTestServer serves on a random local port and returns its address.
+func startTestServer(t *testing.T, opts ...Option) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := CreateServer(0, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}), opts...).(server)
+	go func() {
+		_ = s.serve(l)
+	}()
+	return l.Addr().String(), func() {
+		_ = s.httpServer.Close()
+	}
+}
+
+func TestServer_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, dir, "ca", nil, x509.ExtKeyUsageAny)
+	serverCert := newTestCert(t, dir, "server", ca, x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCert(t, dir, "client", ca, x509.ExtKeyUsageClientAuth)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{
+			Timeout: time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+			},
+		}
+	}
+	get := func(c *http.Client, url string) error {
+		resp, err := c.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	t.Run("https", func(t *testing.T) {
+		addr, stop := startTestServer(t, WithTLS(serverCert.certFile, serverCert.keyFile))
+		defer stop()
+
+		if err := get(client(), "https://"+addr); err != nil {
+			t.Errorf("HTTPS request failed: %s", err)
+		}
+		if err := get(&http.Client{Timeout: time.Second}, "https://"+addr); err == nil {
+			t.Error("Certificate signed by unknown CA must be rejected by client")
+		}
+	})
+
+	t.Run("mutual tls", func(t *testing.T) {
+		addr, stop := startTestServer(t,
+			WithTLS(serverCert.certFile, serverCert.keyFile),
+			WithClientCA(ca.certFile))
+		defer stop()
+
+		if err := get(client(clientCert.tls()), "https://"+addr); err != nil {
+			t.Errorf("Request with client certificate failed: %s", err)
+		}
+		if err := get(client(), "https://"+addr); err == nil {
+			t.Error("Request without client certificate must fail")
+		}
+
+		other := newTestCert(t, dir, "other-ca", nil, x509.ExtKeyUsageAny)
+		if err := get(client(other.tls()), "https://"+addr); err == nil {
+			t.Error("Client certificate signed by unknown CA must be rejected")
+		}
+	})
+
+	t.Run("client ca without tls", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := CreateServer(0, http.NotFoundHandler(), WithClientCA(ca.certFile)).(server)
+		if err := s.serve(l); err == nil {
+			t.Error("Client CA without certificate must be rejected")
+		}
+	})
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	s := CreateServer(0, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	served := make(chan error, 1)
+	go func() {
+		served <- s.(server).serve(l)
+	}()
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Cannot shut down: %s", err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("In-flight request failed: %s", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Unexpected serve result: %v", err)
+	}
+	if _, err := http.Get("http://" + l.Addr().String()); err == nil {
+		t.Error("Requests must not be accepted after shutdown")
+	}
+}
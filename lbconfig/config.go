@@ -0,0 +1,259 @@
+// Package lbconfig loads the list of backends of the load balancer.
+package lbconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultHealthPath is the health check path of backends that do not set one.
+const DefaultHealthPath = "/health"
+
+// DefaultHealthCheck is used for settings not set in the config.
+var DefaultHealthCheck = HealthCheck{
+	Path:         DefaultHealthPath,
+	Interval:     Duration(10 * time.Second),
+	Timeout:      Duration(3 * time.Second),
+	Rise:         2,
+	Fall:         3,
+	ExpectStatus: http.StatusOK,
+}
+
+// Duration is a time.Duration written as a string in JSON, e.g. "1.5s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// HealthCheck describes how the balancer checks a backend. Zero fields are
+// taken from the config defaults and then from DefaultHealthCheck.
+type HealthCheck struct {
+	// Path is requested with GET.
+	Path string `json:"path,omitempty"`
+	// Interval is the time between checks, a random delay of up to Jitter is
+	// added to it so that checks of backends are spread out.
+	Interval Duration `json:"interval,omitempty"`
+	Jitter   Duration `json:"jitter,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+	// Rise is the number of passed checks in a row to mark a backend healthy,
+	// Fall is the number of failed checks in a row to mark it unhealthy.
+	Rise int `json:"rise,omitempty"`
+	Fall int `json:"fall,omitempty"`
+	// ExpectStatus is the status code of a healthy backend.
+	ExpectStatus int `json:"expectStatus,omitempty"`
+	// ExpectBody must be contained in the response if set.
+	ExpectBody string `json:"expectBody,omitempty"`
+}
+
+// withDefaults returns the health check with zero fields set from def.
+func (h HealthCheck) withDefaults(def HealthCheck) HealthCheck {
+	if h.Path == "" {
+		h.Path = def.Path
+	}
+	if h.Interval == 0 {
+		h.Interval = def.Interval
+	}
+	if h.Jitter == 0 {
+		h.Jitter = def.Jitter
+	}
+	if h.Timeout == 0 {
+		h.Timeout = def.Timeout
+	}
+	if h.Rise == 0 {
+		h.Rise = def.Rise
+	}
+	if h.Fall == 0 {
+		h.Fall = def.Fall
+	}
+	if h.ExpectStatus == 0 {
+		h.ExpectStatus = def.ExpectStatus
+	}
+	if h.ExpectBody == "" {
+		h.ExpectBody = def.ExpectBody
+	}
+	return h
+}
+
+// validate checks the settings and fixes the path missing a leading slash.
+func (h *HealthCheck) validate() error {
+	if !strings.HasPrefix(h.Path, "/") {
+		h.Path = "/" + h.Path
+	}
+	switch {
+	case h.Interval < 0 || h.Jitter < 0 || h.Timeout < 0:
+		return errors.New("negative health check duration")
+	case h.Rise < 0 || h.Fall < 0:
+		return errors.New("negative health check threshold")
+	case h.ExpectStatus < 100 || h.ExpectStatus > 599:
+		return fmt.Errorf("invalid expected status %d", h.ExpectStatus)
+	}
+	return nil
+}
+
+// Backend is a server behind the load balancer.
+type Backend struct {
+	// Address is host:port of the server.
+	Address string `json:"address"`
+	// Weight is used by weighted balancing, 1 if not set.
+	Weight int         `json:"weight,omitempty"`
+	Health HealthCheck `json:"health,omitempty"`
+}
+
+// Config is the config file of the load balancer, e.g.
+//
+//	{
+//		"health": {"interval": "5s", "rise": 2, "fall": 3},
+//		"backends": [
+//			{"address": "server1:8080", "weight": 2},
+//			{"address": "server2:8080", "health": {"path": "/ping", "expectBody": "ok"}}
+//		]
+//	}
+type Config struct {
+	// Health is the default health check of backends.
+	Health   HealthCheck `json:"health,omitempty"`
+	Backends []Backend   `json:"backends"`
+}
+
+// Load reads the config file.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var conf Config
+	if err := json.NewDecoder(f).Decode(&conf); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if err := conf.normalize(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &conf, nil
+}
+
+// FromList creates the config from comma separated addresses with optional
+// weights, e.g. server1:8080=2,server2:8080. All backends are checked with
+// health.
+func FromList(list string, health HealthCheck) (*Config, error) {
+	conf := Config{Health: health}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		b := Backend{Address: item}
+		if i := strings.LastIndexByte(item, '='); i != -1 {
+			weight, err := strconv.Atoi(item[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight of %s: %w", item, err)
+			}
+			b.Address, b.Weight = item[:i], weight
+		}
+		conf.Backends = append(conf.Backends, b)
+	}
+
+	if err := conf.normalize(); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// normalize sets defaults and validates backends.
+func (c *Config) normalize() error {
+	if len(c.Backends) == 0 {
+		return errors.New("no backends")
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.Backends {
+		b := &c.Backends[i]
+		if b.Address == "" {
+			return fmt.Errorf("backend %d has no address", i)
+		}
+		if seen[b.Address] {
+			return fmt.Errorf("duplicate backend %s", b.Address)
+		}
+		seen[b.Address] = true
+
+		if b.Weight < 0 {
+			return fmt.Errorf("negative weight of %s", b.Address)
+		}
+		if b.Weight == 0 {
+			b.Weight = 1
+		}
+		b.Health = b.Health.withDefaults(c.Health).withDefaults(DefaultHealthCheck)
+		if err := b.Health.validate(); err != nil {
+			return fmt.Errorf("backend %s: %w", b.Address, err)
+		}
+	}
+	return nil
+}
+
+// Watch calls reload with the config loaded from path when the process
+// receives SIGHUP or when the modification time of the file changes, which is
+// checked every interval. Invalid configs are logged and skipped. Watch
+// returns when ctx is done.
+func Watch(ctx context.Context, path string, interval time.Duration, reload func(*Config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	lastMod := modTime()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("Reloading %s on SIGHUP", path)
+		case <-ticker.C:
+			mod := modTime()
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			log.Printf("Reloading changed %s", path)
+		}
+
+		conf, err := Load(path)
+		if err != nil {
+			log.Printf("Failed to reload config: %s", err)
+			continue
+		}
+		reload(conf)
+	}
+}
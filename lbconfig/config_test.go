@@ -0,0 +1,129 @@
+package lbconfig
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFromList(t *testing.T) {
+	conf, err := FromList("server1:8080=3, server2:8080,", HealthCheck{Path: "/ping", Rise: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := DefaultHealthCheck
+	health.Path, health.Rise = "/ping", 1
+	expected := []Backend{
+		{Address: "server1:8080", Weight: 3, Health: health},
+		{Address: "server2:8080", Weight: 1, Health: health},
+	}
+	if !reflect.DeepEqual(conf.Backends, expected) {
+		t.Errorf("Unexpected backends %+v", conf.Backends)
+	}
+
+	for _, list := range []string{"", "a:1=x", "a:1=-1", "a:1,a:1"} {
+		if _, err := FromList(list, HealthCheck{}); err == nil {
+			t.Errorf("List %q must be rejected", list)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lbconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		data     string
+		expected *HealthCheck
+	}{
+		{
+			data: `{
+				"health": {"interval": "5s", "jitter": "1s", "fall": 1},
+				"backends": [{"address": "server1:8080", "health": {"path": "ping", "expectBody": "ok"}}]
+			}`,
+			expected: &HealthCheck{
+				Path:         "/ping",
+				Interval:     Duration(5 * time.Second),
+				Jitter:       Duration(time.Second),
+				Timeout:      DefaultHealthCheck.Timeout,
+				Rise:         DefaultHealthCheck.Rise,
+				Fall:         1,
+				ExpectStatus: http.StatusOK,
+				ExpectBody:   "ok",
+			},
+		},
+		{data: `{"health": {"interval": 5}, "backends": [{"address": "server1:8080"}]}`},
+		{data: `{"health": {"timeout": "-1s"}, "backends": [{"address": "server1:8080"}]}`},
+		{data: `{"backends": [{"address": "server1:8080", "health": {"expectStatus": 1000}}]}`},
+	} {
+		path := filepath.Join(dir, "lb.json")
+		if err := ioutil.WriteFile(path, []byte(tc.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		conf, err := Load(path)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("Config %s must be rejected", tc.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conf.Backends[0].Health != *tc.expected {
+			t.Errorf("Unexpected health check %+v", conf.Backends[0].Health)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lbconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lb.json")
+	write := func(data string, mod time.Time) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write(`{"backends": [{"address": "server1:8080"}]}`, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan *Config, 1)
+	go Watch(ctx, path, 10*time.Millisecond, func(c *Config) {
+		reloaded <- c
+	})
+	time.Sleep(30 * time.Millisecond)
+
+	// Invalid configs are skipped.
+	write(`{"backends": []}`, now.Add(time.Second))
+	time.Sleep(30 * time.Millisecond)
+	write(`{"backends": [{"address": "server2:8080", "weight": 2}]}`, now.Add(2*time.Second))
+
+	select {
+	case c := <-reloaded:
+		expected := []Backend{{Address: "server2:8080", Weight: 2, Health: DefaultHealthCheck}}
+		if !reflect.DeepEqual(c.Backends, expected) {
+			t.Errorf("Unexpected reloaded backends %+v", c.Backends)
+		}
+	case <-time.After(time.Second):
+		t.Error("Changed config was not reloaded")
+	}
+}
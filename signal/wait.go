@@ -1,15 +1,24 @@
 package signal
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
-func WaitForTerminationSignal() {
-	intChannel := make(chan os.Signal)
+// TerminationContext returns a context that is cancelled when the process
+// receives SIGINT or SIGTERM.
+func TerminationContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	intChannel := make(chan os.Signal, 1)
 	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM)
-	<-intChannel
-	log.Println("Shutting down...")
+	go func() {
+		<-intChannel
+		signal.Stop(intChannel)
+		log.Println("Shutting down...")
+		cancel()
+	}()
+	return ctx
 }